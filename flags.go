@@ -1,11 +1,17 @@
 package main
 
 import (
+	"crypto/ecdh"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/twitchyliquid64/subnet/subnet"
+	"github.com/twitchyliquid64/subnet/subnet/conn"
 )
 
 var interfaceNameVar string
@@ -24,6 +30,59 @@ var gatewayVar string
 
 var crlPathVar string
 
+var kernelTLSVar bool
+
+var limitsPathVar string
+var quotaStatePathVar string
+var eventCmdVar string
+var commonNameVar string
+
+var routesVar string
+var excludeRoutesVar string
+
+var killSwitchVar bool
+var killSwitchLANVar bool
+
+var dnsServersVar string
+var dnsSearchVar string
+var ignoreServerDNSVar bool
+var dnsZoneVar string
+var dnsUpstreamVar string
+var natInterfaceVar string
+var layerVar int
+var bridgeVar string
+var multicastVar string
+var multicastGroupsVar string
+var multicastAllowPathVar string
+var isolateVar bool
+var groupsPathVar string
+var tenantsPathVar string
+var serverNameVar string
+var serverSelectionVar string
+var sessionGraceVar time.Duration
+var peerListenVar string
+var peersVar string
+var peerCAPathVar string
+var controlPathVar string
+var proxyVar string
+var proxyAuthPathVar string
+var webSocketVar bool
+var wsPathVar string
+var wsListenVar string
+var wsPlainVar bool
+var wsBehindProxyVar bool
+var fallbackVar string
+var vpnSNIVar string
+var transportVar string
+var obfsKeyPathVar string
+var noiseKeyPathVar string
+var noiseServerKeyVar string
+var noisePeersPathVar string
+var secondFactorVar bool
+var authUsersPathVar string
+
+var journalPathVar string
+
 func printUsage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "%s <server address>\n", os.Args[0])
@@ -39,19 +98,67 @@ func parseFlags() {
 	flag.StringVar(&connPortVar, "port", "3234", "Port for the VPN connection")
 	flag.StringVar(&modeVar, "mode", "client", "Whether the process starts a server or as a client")
 	flag.StringVar(&networkAddrVar, "network", "192.168.69.1/24", "Address for this interface with netmask")
-	flag.StringVar(&gatewayVar, "gw", "", "(Client only) Set the default gateway to this value")
+	flag.StringVar(&gatewayVar, "gw", "", "(Client only) Route all traffic through the VPN, whose gateway has this address")
 	flag.StringVar(&crlPathVar, "crl", "", "Optional path to JSON-CRL file")
 	flag.StringVar(&additionalClientAddrs, "req-addrs", "", "(Client only) Additional addresses to associate with the client")
+	flag.BoolVar(&kernelTLSVar, "ktls", false, "Offload TLS encryption to the kernel after the handshake (linux only)")
+	flag.StringVar(&limitsPathVar, "limits", "", "(Server only) Optional path to JSON file of per-client bandwidth limits and quotas")
+	flag.StringVar(&quotaStatePathVar, "quota-state", "", "(Server only) Path at which quota usage is persisted")
+	flag.StringVar(&eventCmdVar, "event-cmd", "", "(Server only) Command to run with the kind, client & detail of each event")
+	flag.StringVar(&commonNameVar, "cn", "", "(make-client-cert only) Name of the client, embedded in the certificate")
+	flag.StringVar(&routesVar, "routes", "", "(Client only) Comma-separated list of additional networks (CIDR) to route through the VPN")
+	flag.StringVar(&excludeRoutesVar, "exclude-routes", "", "(Client only) Comma-separated list of networks (CIDR) which bypass the VPN when -gw is set")
+	flag.BoolVar(&killSwitchVar, "kill-switch", false, "(Client only) Block all traffic outside the VPN, even while reconnecting (linux only)")
+	flag.BoolVar(&killSwitchLANVar, "kill-switch-lan", false, "(Client only) Permit traffic to the local network while the kill switch is enabled")
+	flag.StringVar(&dnsServersVar, "dns", "", "Comma-separated list of DNS servers to use while connected (server: sent to clients)")
+	flag.StringVar(&dnsSearchVar, "dns-search", "", "Comma-separated list of DNS search domains to use while connected (server: sent to clients)")
+	flag.BoolVar(&ignoreServerDNSVar, "ignore-server-dns", false, "(Client only) Do not apply DNS configuration sent by the server")
+	flag.StringVar(&dnsZoneVar, "dns-zone", "", "(Server only) Serve DNS on the VPN address, resolving <client name>.<zone> to connected clients")
+	flag.StringVar(&dnsUpstreamVar, "dns-upstream", "", "(Server only) Resolver for queries outside -dns-zone (default: first nameserver in /etc/resolv.conf)")
+	flag.StringVar(&natInterfaceVar, "nat", "", "(Server only) Enable forwarding & NAT of VPN traffic out this interface ('auto' for the default route's interface)")
+	flag.IntVar(&layerVar, "layer", 3, "Tunnel IP packets over a TUN device (3), or ethernet frames over a TAP device (2)")
+	flag.StringVar(&bridgeVar, "bridge", "", "(Server only) Add the TAP device to this bridge instead of assigning it an address (-layer 2 only)")
+	flag.StringVar(&multicastVar, "multicast", "", "Replicate multicast & broadcast between clients: 'flood' to all clients, or 'snoop' to subscribed clients (IGMP snooping). Clients accept either value")
+	flag.StringVar(&multicastGroupsVar, "multicast-groups", "", "(Server only) Comma-separated list of multicast groups (CIDR) which may be replicated (default all)")
+	flag.BoolVar(&isolateVar, "isolate", false, "(Server only) Prevent clients from communicating with each other, unless they share a group")
+	flag.StringVar(&multicastAllowPathVar, "multicast-allow", "", "(Server only) Path to JSON file of the multicast groups (CIDR) which each client, or the members of each client group (-groups), may send & receive")
+	flag.StringVar(&groupsPathVar, "groups", "", "(Server only) Path to JSON file of named groups of clients which may communicate when isolated")
+	flag.StringVar(&tenantsPathVar, "tenants", "", "(Server only) Path to JSON file of tenant networks to host, each with its own CA & network")
+	flag.DurationVar(&sessionGraceVar, "session-grace", 30*time.Second, "(Server only) How long to keep the routes of a disconnected client, so it can resume its session (0 to disable)")
+	flag.StringVar(&peerListenVar, "peer-listen", "", "(Server only) Address on which to accept links from peer servers, e.g. :3235")
+	flag.StringVar(&peersVar, "peers", "", "(Server only) Comma-separated list of peer servers (host:port) to link to and exchange client routes with")
+	flag.StringVar(&peerCAPathVar, "peer-ca", "", "(Server only) Path to PEM-encoded cert of the CA which signs peer server certificates")
+	flag.StringVar(&serverSelectionVar, "server-selection", subnet.ServerSelectionPriority, "(Client only) Order in which to prefer servers, when a comma-separated list is given: 'priority' (as listed) or 'latency'")
+	flag.StringVar(&serverNameVar, "sni", "", "(Client only) Server name to send in the TLS handshake, selecting a tenant of a multi-tenant server")
+	flag.BoolVar(&webSocketVar, "websocket", false, "(Client only) Connect with a WebSocket over HTTPS at -ws-path, to pass firewalls which only permit web traffic")
+	flag.StringVar(&wsPathVar, "ws-path", subnet.DefaultWebSocketPath, "Path of the WebSocket on the server")
+	flag.StringVar(&wsListenVar, "ws-listen", "", "(Server only) Address on which to accept clients over a WebSocket at -ws-path, e.g. :443")
+	flag.BoolVar(&wsPlainVar, "ws-plain", false, "(Server only) Serve the WebSocket over plain HTTP, behind a reverse proxy which terminates TLS")
+	flag.BoolVar(&wsBehindProxyVar, "ws-behind-proxy", false, "(Client only) Also accept a certificate valid for the server's host name under the system's trusted roots, from a reverse proxy in front of the server")
+	flag.StringVar(&fallbackVar, "fallback", "", "(Server only) Share the port with another TLS service (e.g. a web server) at this address, proxying connections which are not for the VPN to it")
+	flag.StringVar(&vpnSNIVar, "vpn-sni", "", "(Server only) Comma-separated list of server names which identify VPN connections, in addition to subnet's ALPN protocol (-fallback only)")
+	flag.StringVar(&transportVar, "transport", "tls", "Transport for the VPN connection: 'tls', or 'obfs' to disguise it as random bytes with randomised framing & timing (needs -obfs-key)")
+	flag.StringVar(&obfsKeyPathVar, "obfs-key", "", "Path to a file holding the key shared by clients & server, for -transport obfs")
+	flag.StringVar(&noiseKeyPathVar, "noise-key", "", "Path to our private key (see -mode genkey), to authenticate with a Noise handshake instead of certificates")
+	flag.StringVar(&noiseServerKeyVar, "noise-server-key", "", "(Client only) Public key of the server, for -noise-key")
+	flag.StringVar(&noisePeersPathVar, "noise-peers", "", "(Server only) Path to JSON file of the names, public keys & addresses of clients, for -noise-key")
+	flag.BoolVar(&secondFactorVar, "2fa", false, "(Client only) Answer the server's challenge for a TOTP code or password after the handshake, prompting on the terminal")
+	flag.StringVar(&authUsersPathVar, "2fa-users", "", "(Server only) Path to JSON file of the TOTP secrets & password hashes of clients, which must be presented after the handshake")
+	flag.StringVar(&proxyVar, "proxy", "", "(Client only) Connect through this proxy: http://[user:pass@]host:port (CONNECT) or socks5://[user:pass@]host:port")
+	flag.StringVar(&proxyAuthPathVar, "proxy-auth", "", "(Client only) Path to a file holding the proxy credentials as user:pass, rather than in the -proxy URL (default $"+subnet.ProxyCredentialsEnv+")")
+	flag.StringVar(&controlPathVar, "control", "", "(Client only) Path of a unix socket accepting commands (retry, status) from '-mode control'")
+	flag.StringVar(&journalPathVar, "journal", "", "Path to the journal of network changes to undo after a crash (default "+subnet.DefaultJournalDir+"/<mode>.journal)")
 
 	flag.Usage = printUsage
 	flag.Parse()
 
-	if modeVar != "init-server-certs" && modeVar != "make-client-cert" && modeVar != "blacklist-cert" && flag.NArg() != 1 {
+	if modeVar != "init-server-certs" && modeVar != "make-client-cert" && modeVar != "blacklist-cert" && modeVar != "cleanup" && modeVar != "unlock" &&
+		modeVar != "genkey" && modeVar != "pubkey" && flag.NArg() != 1 {
 		printUsage()
 		os.Exit(2)
 	}
 
-	if modeVar == "server" {
+	if modeVar == "server" && noiseKeyPathVar == "" {
 		if ourCertPathVar == "" || ourKeyPathVar == "" {
 			fmt.Fprintf(os.Stderr, "Err: Certificate and key must be specified for server mode.\n")
 			flag.PrintDefaults()
@@ -103,5 +210,269 @@ func parseFlags() {
 		}
 	}
 
+	if _, err := parseNetworks(routesVar); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: --routes %s.\n", err)
+		os.Exit(2)
+	}
+	if _, err := parseNetworks(excludeRoutesVar); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: --exclude-routes %s.\n", err)
+		os.Exit(2)
+	}
+	if excludeRoutesVar != "" && gatewayVar == "" {
+		fmt.Fprintf(os.Stderr, "Err: --exclude-routes can only be used with -gw.\n")
+		os.Exit(2)
+	}
+
+	if killSwitchLANVar && !killSwitchVar {
+		fmt.Fprintf(os.Stderr, "Err: --kill-switch-lan can only be used with --kill-switch.\n")
+		os.Exit(2)
+	}
+
+	for i, addrStr := range strings.Split(dnsServersVar, ",") {
+		if addrStr != "" && net.ParseIP(addrStr) == nil {
+			fmt.Fprintf(os.Stderr, "Err: --dns server (index %d) is not a valid IP address.\n", i)
+			os.Exit(2)
+		}
+	}
+
+	if layerVar != 2 && layerVar != 3 {
+		fmt.Fprintf(os.Stderr, "Err: --layer must be 2 or 3.\n")
+		os.Exit(2)
+	}
+	if bridgeVar != "" && layerVar != 2 {
+		fmt.Fprintf(os.Stderr, "Err: --bridge can only be used with -layer 2.\n")
+		os.Exit(2)
+	}
+
+	if serverSelectionVar != subnet.ServerSelectionPriority && serverSelectionVar != subnet.ServerSelectionLatency {
+		fmt.Fprintf(os.Stderr, "Err: --server-selection must be 'priority' or 'latency'.\n")
+		os.Exit(2)
+	}
+
+	if multicastVar != "" && multicastVar != subnet.MulticastFlood && multicastVar != subnet.MulticastSnoop {
+		fmt.Fprintf(os.Stderr, "Err: --multicast must be 'flood' or 'snoop'.\n")
+		os.Exit(2)
+	}
+	if _, err := parseNetworks(multicastGroupsVar); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: --multicast-groups %s.\n", err)
+		os.Exit(2)
+	}
+
+	if multicastAllowPathVar != "" {
+		if multicastVar == "" {
+			fmt.Fprintf(os.Stderr, "Err: --multicast-allow can only be used with -multicast.\n")
+			os.Exit(2)
+		}
+		if _, err := subnet.ReadMulticastAllow(multicastAllowPathVar); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: --multicast-allow %s.\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if groupsPathVar != "" && !isolateVar && multicastAllowPathVar == "" {
+		fmt.Fprintf(os.Stderr, "Err: --groups can only be used with -isolate or -multicast-allow.\n")
+		os.Exit(2)
+	}
+
+	if tenantsPathVar != "" {
+		if limitsPathVar != "" || quotaStatePathVar != "" || natInterfaceVar != "" || isolateVar || groupsPathVar != "" || layerVar != 3 || multicastVar != "" {
+			fmt.Fprintf(os.Stderr, "Err: --limits, --quota-state, --nat, --isolate, --groups, --layer and --multicast cannot be used with -tenants (set them per tenant).\n")
+			os.Exit(2)
+		}
+		if _, err := subnet.ReadTenants(tenantsPathVar); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: --tenants %s.\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if (peerListenVar != "" || peersVar != "") && peerCAPathVar == "" {
+		fmt.Fprintf(os.Stderr, "Err: --peer-ca must be specified to link to peer servers.\n")
+		os.Exit(2)
+	}
+	if (peerListenVar != "" || peersVar != "") && (tenantsPathVar != "" || layerVar != 3) {
+		fmt.Fprintf(os.Stderr, "Err: --peer-listen and --peers cannot be used with -tenants or -layer 2.\n")
+		os.Exit(2)
+	}
+
+	if proxyVar != "" {
+		if _, err := subnet.ParseProxy(proxyVar); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: --proxy %s.\n", err)
+			os.Exit(2)
+		}
+	}
+	if proxyAuthPathVar != "" && proxyVar == "" {
+		fmt.Fprintf(os.Stderr, "Err: --proxy-auth can only be used with -proxy.\n")
+		os.Exit(2)
+	}
+
+	if !strings.HasPrefix(wsPathVar, "/") {
+		fmt.Fprintf(os.Stderr, "Err: --ws-path must start with /.\n")
+		os.Exit(2)
+	}
+	if webSocketVar && kernelTLSVar {
+		fmt.Fprintf(os.Stderr, "Err: --websocket cannot be used with -ktls.\n")
+		os.Exit(2)
+	}
+	if wsBehindProxyVar && !webSocketVar {
+		fmt.Fprintf(os.Stderr, "Err: --ws-behind-proxy can only be used with -websocket.\n")
+		os.Exit(2)
+	}
+	if wsPlainVar && wsListenVar == "" {
+		fmt.Fprintf(os.Stderr, "Err: --ws-plain can only be used with -ws-listen.\n")
+		os.Exit(2)
+	}
+	if wsListenVar != "" && tenantsPathVar != "" {
+		fmt.Fprintf(os.Stderr, "Err: --ws-listen cannot be used with -tenants.\n")
+		os.Exit(2)
+	}
+
+	if vpnSNIVar != "" && fallbackVar == "" {
+		fmt.Fprintf(os.Stderr, "Err: --vpn-sni can only be used with -fallback.\n")
+		os.Exit(2)
+	}
+
+	switch transportVar {
+	case "tls":
+		if obfsKeyPathVar != "" {
+			fmt.Fprintf(os.Stderr, "Err: --obfs-key can only be used with -transport obfs.\n")
+			os.Exit(2)
+		}
+	case "obfs":
+		if obfsKeyPathVar == "" {
+			fmt.Fprintf(os.Stderr, "Err: --obfs-key must be specified for -transport obfs.\n")
+			os.Exit(2)
+		}
+		if _, err := conn.LoadObfsKey(obfsKeyPathVar); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: --obfs-key %s.\n", err)
+			os.Exit(2)
+		}
+		if webSocketVar || kernelTLSVar || fallbackVar != "" {
+			fmt.Fprintf(os.Stderr, "Err: --transport obfs cannot be used with -websocket, -ktls or -fallback.\n")
+			os.Exit(2)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Err: --transport must be tls or obfs.\n")
+		os.Exit(2)
+	}
+
+	if noiseKeyPathVar != "" {
+		if _, err := conn.LoadNoiseKey(noiseKeyPathVar); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: --noise-key %s.\n", err)
+			os.Exit(2)
+		}
+		if modeVar == "client" {
+			if _, err := conn.ParseNoisePublicKey(noiseServerKeyVar); err != nil {
+				fmt.Fprintf(os.Stderr, "Err: --noise-server-key must be the server's public key (%s).\n", err)
+				os.Exit(2)
+			}
+		}
+		if modeVar == "server" {
+			if noisePeersPathVar == "" {
+				fmt.Fprintf(os.Stderr, "Err: --noise-peers must be specified for -noise-key.\n")
+				os.Exit(2)
+			}
+			if _, err := subnet.ReadNoisePeers(noisePeersPathVar); err != nil {
+				fmt.Fprintf(os.Stderr, "Err: --noise-peers %s.\n", err)
+				os.Exit(2)
+			}
+		}
+		if webSocketVar || wsListenVar != "" || kernelTLSVar || fallbackVar != "" || tenantsPathVar != "" {
+			fmt.Fprintf(os.Stderr, "Err: --noise-key cannot be used with -websocket, -ws-listen, -ktls, -fallback or -tenants.\n")
+			os.Exit(2)
+		}
+	} else if noiseServerKeyVar != "" || noisePeersPathVar != "" {
+		fmt.Fprintf(os.Stderr, "Err: --noise-server-key and --noise-peers can only be used with -noise-key.\n")
+		os.Exit(2)
+	}
+
+	if authUsersPathVar != "" {
+		if _, err := subnet.ReadAuthUsers(authUsersPathVar); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: --2fa-users %s.\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if modeVar == "control" {
+		if controlPathVar == "" {
+			fmt.Fprintf(os.Stderr, "Err: --control must be specified. EG: ./subnet -mode control -control <socketPath> retry\n")
+			os.Exit(2)
+		}
+		if cmd := flag.Arg(0); cmd != "retry" && cmd != "status" {
+			fmt.Fprintf(os.Stderr, "Err: Unknown control command %q, expected retry or status.\n", cmd)
+			os.Exit(2)
+		}
+	}
+
+	if journalPathVar == "" && (modeVar == "client" || modeVar == "server") {
+		journalPathVar = filepath.Join(subnet.DefaultJournalDir, modeVar+".journal")
+	}
+
 	serverAddressVar = flag.Arg(0)
 }
+
+// dnsConfig returns the DNS configuration specified by flags, or nil if none was.
+func dnsConfig() *subnet.DNSConfig {
+	var c subnet.DNSConfig
+	for _, addrStr := range strings.Split(dnsServersVar, ",") {
+		if addrStr != "" {
+			c.Servers = append(c.Servers, net.ParseIP(addrStr))
+		}
+	}
+	for _, domain := range strings.Split(dnsSearchVar, ",") {
+		if domain != "" {
+			c.Search = append(c.Search, domain)
+		}
+	}
+	if c.Empty() {
+		return nil
+	}
+	return &c
+}
+
+// obfsKey returns the key for the obfuscated transport, or nil if it is not
+// in use.
+func obfsKey() []byte {
+	if transportVar != "obfs" {
+		return nil
+	}
+	key, _ := conn.LoadObfsKey(obfsKeyPathVar)
+	return key
+}
+
+// noiseKeys returns our Noise key and the server's public key, or nil if
+// Noise is not in use.
+func noiseKeys() (*ecdh.PrivateKey, *ecdh.PublicKey) {
+	if noiseKeyPathVar == "" {
+		return nil, nil
+	}
+	key, _ := conn.LoadNoiseKey(noiseKeyPathVar)
+	serverKey, _ := conn.ParseNoisePublicKey(noiseServerKeyVar)
+	return key, serverKey
+}
+
+// parseNetworks parses a comma-separated list of networks in CIDR notation.
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for i, netStr := range strings.Split(list, ",") {
+		if netStr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(netStr)
+		if err != nil {
+			return nil, fmt.Errorf("network (index %d) is not valid: %v", i, err)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// splitList splits a comma-separated list, omitting empty items.
+func splitList(list string) []string {
+	var out []string
+	for _, item := range strings.Split(list, ",") {
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
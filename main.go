@@ -3,15 +3,19 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 
 	"github.com/twitchyliquid64/subnet/subnet"
 	"github.com/twitchyliquid64/subnet/subnet/cert"
+	"github.com/twitchyliquid64/subnet/subnet/conn"
 )
 
 func main() {
@@ -23,6 +27,18 @@ func main() {
 		checkErr(crlStartErr, "init-crl")
 	}
 
+	if modeVar == "client" || modeVar == "server" {
+		// Held until exit, so another instance cannot restore our journal.
+		lock, err := subnet.LockJournal(journalPathVar)
+		if err == subnet.ErrJournalInUse {
+			err = fmt.Errorf("%s is in use by another subnet process (use -journal to run several)", journalPathVar)
+		}
+		checkErr(err, "lock-journal")
+		defer lock.Close()
+		// Undo changes left behind by a previous run which did not exit cleanly.
+		checkErr(subnet.RestoreJournal(journalPathVar), "restore-journal")
+	}
+
 	switch modeVar {
 	case "client":
 		var additionalAddrs []net.IP
@@ -31,18 +47,108 @@ func main() {
 				additionalAddrs = append(additionalAddrs, net.ParseIP(addrStr))
 			}
 		}
-		c, err := subnet.NewClient(serverAddressVar, connPortVar, networkAddrVar, interfaceNameVar, gatewayVar, ourCertPathVar, ourKeyPathVar, caCertPathVar, additionalAddrs)
+		routes, _ := parseNetworks(routesVar)
+		excludeRoutes, _ := parseNetworks(excludeRoutesVar)
+		var proxy *url.URL
+		if proxyVar != "" {
+			proxy, _ = subnet.ParseProxy(proxyVar)
+			if proxy.User == nil {
+				user, err := subnet.ProxyCredentials(proxyAuthPathVar)
+				checkErr(err, "proxy-auth")
+				proxy.User = user
+			}
+		}
+		var wsPath string
+		if webSocketVar {
+			wsPath = wsPathVar
+		}
+		noiseKey, noiseServerKey := noiseKeys()
+		c, err := subnet.NewClient(serverAddressVar, connPortVar, networkAddrVar, interfaceNameVar, gatewayVar, ourCertPathVar, ourKeyPathVar, caCertPathVar, additionalAddrs, subnet.ClientOptions{
+			KernelTLS:            kernelTLSVar,
+			ObfuscationKey:       obfsKey(),
+			NoiseKey:             noiseKey,
+			NoiseServerKey:       noiseServerKey,
+			SecondFactor:         secondFactorVar,
+			Routes:               routes,
+			ExcludeRoutes:        excludeRoutes,
+			KillSwitch:           killSwitchVar,
+			KillSwitchLAN:        killSwitchLANVar,
+			DNS:                  dnsConfig(),
+			IgnoreServerDNS:      ignoreServerDNSVar,
+			Layer2:               layerVar == 2,
+			Multicast:            multicastVar != "",
+			ServerSelection:      serverSelectionVar,
+			ServerName:           serverNameVar,
+			ControlPath:          controlPathVar,
+			Proxy:                proxy,
+			WebSocketPath:        wsPath,
+			WebSocketBehindProxy: wsBehindProxyVar,
+			JournalPath:          journalPathVar,
+		})
 		checkErr(err, "subnet.NewClient()")
 		c.Run()
 		defer func() { checkErr(c.Close(), "client.Close()") }()
-		waitInterrupt(fatalErrChan)
+		waitInterrupt(fatalErrChan, c.QueueStats)
 
 	case "server":
-		s, err := subnet.NewServer(serverAddressVar, connPortVar, networkAddrVar, interfaceNameVar, ourCertPathVar, ourKeyPathVar, caCertPathVar)
+		if tenantsPathVar != "" {
+			tenants, _ := subnet.ReadTenants(tenantsPathVar)
+			s, err := subnet.NewMultiServer(serverAddressVar, connPortVar, tenants, ourCertPathVar, ourKeyPathVar, subnet.ServerOptions{
+				KernelTLS:      kernelTLSVar,
+				ObfuscationKey: obfsKey(),
+				AuthUsersPath:  authUsersPathVar,
+				EventCmd:       eventCmdVar,
+				DNS:            dnsConfig(),
+				DNSZone:        dnsZoneVar,
+				DNSUpstream:    dnsUpstreamVar,
+				Fallback:       fallbackVar,
+				ServerNames:    splitList(vpnSNIVar),
+				SessionGrace:   sessionGraceVar,
+				JournalPath:    journalPathVar,
+			})
+			checkErr(err, "subnet.NewMultiServer()")
+			s.Run()
+			defer func() { checkErr(s.Close(), "server.Close()") }()
+			waitInterrupt(fatalErrChan, s.QueueStats)
+			break
+		}
+		multicastGroups, _ := parseNetworks(multicastGroupsVar)
+		noiseKey, _ := noiseKeys()
+		s, err := subnet.NewServer(serverAddressVar, connPortVar, networkAddrVar, interfaceNameVar, ourCertPathVar, ourKeyPathVar, caCertPathVar, subnet.ServerOptions{
+			KernelTLS:          kernelTLSVar,
+			ObfuscationKey:     obfsKey(),
+			NoiseKey:           noiseKey,
+			NoisePeersPath:     noisePeersPathVar,
+			AuthUsersPath:      authUsersPathVar,
+			LimitsPath:         limitsPathVar,
+			QuotaStatePath:     quotaStatePathVar,
+			EventCmd:           eventCmdVar,
+			DNS:                dnsConfig(),
+			DNSZone:            dnsZoneVar,
+			DNSUpstream:        dnsUpstreamVar,
+			NATInterface:       natInterfaceVar,
+			Layer2:             layerVar == 2,
+			Bridge:             bridgeVar,
+			Multicast:          multicastVar,
+			MulticastGroups:    multicastGroups,
+			MulticastAllowPath: multicastAllowPathVar,
+			IsolateClients:     isolateVar,
+			GroupsPath:         groupsPathVar,
+			PeerListen:         peerListenVar,
+			Peers:              splitList(peersVar),
+			PeerCAPath:         peerCAPathVar,
+			WebSocketListen:    wsListenVar,
+			WebSocketPath:      wsPathVar,
+			WebSocketPlain:     wsPlainVar,
+			Fallback:           fallbackVar,
+			ServerNames:        splitList(vpnSNIVar),
+			SessionGrace:       sessionGraceVar,
+			JournalPath:        journalPathVar,
+		})
 		checkErr(err, "subnet.NewServer()")
 		s.Run()
 		defer func() { checkErr(s.Close(), "server.Close()") }()
-		waitInterrupt(fatalErrChan)
+		waitInterrupt(fatalErrChan, s.QueueStats)
 
 	case "init-server-certs":
 		err := cert.MakeServerCert(ourCertPathVar, ourKeyPathVar, caCertPathVar, caKeyPathVar)
@@ -50,10 +156,60 @@ func main() {
 		fmt.Println("NOTICE: Certificates expire (and will need to be rotated) one year from now.")
 
 	case "make-client-cert":
-		err := cert.IssueClientCert(caCertPathVar, caKeyPathVar, flag.Arg(0), flag.Arg(1))
+		err := cert.IssueClientCert(caCertPathVar, caKeyPathVar, flag.Arg(0), flag.Arg(1), commonNameVar)
 		fmt.Println("NOTICE: Certificates expire (and will need to be rotated) one year from now.")
 		checkErr(err, "make-client-cert")
 
+	case "cleanup":
+		paths := []string{journalPathVar}
+		if journalPathVar == "" {
+			paths = []string{
+				filepath.Join(subnet.DefaultJournalDir, "client.journal"),
+				filepath.Join(subnet.DefaultJournalDir, "server.journal"),
+			}
+		}
+		for _, p := range paths {
+			lock, err := subnet.LockJournal(p)
+			if err == subnet.ErrJournalInUse {
+				log.Printf("Skipping %s, which is in use by a running subnet process\n", p)
+				continue
+			}
+			checkErr(err, "cleanup")
+			checkErr(subnet.RestoreJournal(p), "cleanup")
+			lock.Close()
+		}
+
+	case "unlock":
+		// Remove the kill switch left behind by a client which is no longer running.
+		if journalPathVar == "" {
+			journalPathVar = filepath.Join(subnet.DefaultJournalDir, "client.journal")
+		}
+		lock, err := subnet.LockJournal(journalPathVar)
+		if err == subnet.ErrJournalInUse {
+			err = fmt.Errorf("%s is in use by a running client, which removes the kill switch when it exits", journalPathVar)
+		}
+		checkErr(err, "unlock")
+		checkErr(subnet.RemoveKillSwitch(journalPathVar), "unlock")
+		lock.Close()
+
+	case "control":
+		reply, err := subnet.ControlCommand(controlPathVar, flag.Arg(0))
+		checkErr(err, "control")
+		fmt.Println(reply)
+
+	case "genkey":
+		key, err := conn.GenerateNoiseKey()
+		checkErr(err, "genkey")
+		fmt.Println(conn.EncodeNoiseKey(key.Bytes()))
+
+	case "pubkey":
+		// Read a private key from stdin, as printed by genkey.
+		d, err := ioutil.ReadAll(os.Stdin)
+		checkErr(err, "pubkey")
+		key, err := conn.ParseNoisePrivateKey(string(d))
+		checkErr(err, "pubkey")
+		fmt.Println(conn.EncodeNoiseKey(key.PublicKey().Bytes()))
+
 	case "blacklist-cert":
 		err := cert.AddToCRL(crlPathVar, flag.Arg(0), flag.Arg(1))
 		checkErr(err, "blacklist-cert")
@@ -71,12 +227,22 @@ func checkErr(err error, component string) {
 	}
 }
 
-func waitInterrupt(fatalErrChan chan error) {
+// waitInterrupt blocks until the process is signalled to exit, logging queue
+// statistics whenever SIGUSR1 is received.
+func waitInterrupt(fatalErrChan chan error, queueStats func() map[string]subnet.QueueStats) {
 	sig := make(chan os.Signal, 2)
 	done := make(chan bool, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 	go func() {
-		<-sig
+		for s := range sig {
+			if s != syscall.SIGUSR1 {
+				break
+			}
+			for name, st := range queueStats() {
+				log.Printf("Queue %s: backlog=%d enqueued=%d dropped=%d overlimit=%d avg-delay=%s max-delay=%s\n",
+					name, st.Backlog, st.Enqueued, st.Dropped, st.Overlimit, st.AvgDelay, st.MaxDelay)
+			}
+		}
 		done <- true
 	}()
 
@@ -0,0 +1,327 @@
+package subnet
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Factors a client may be challenged for after the handshake.
+const (
+	AuthFactorTOTP     = "totp"
+	AuthFactorPassword = "password"
+)
+
+const (
+	// authTimeout bounds the exchange, including the time taken to type
+	// the answers.
+	authTimeout = 2 * time.Minute
+	// authAttempts is how many wrong answers are accepted per connection.
+	authAttempts = 3
+	// After each wrong answer for an identity, on any connection, further
+	// answers are refused for a delay which doubles from authMinDelay with
+	// each consecutive failure, up to authMaxDelay.
+	authMinDelay = time.Second
+	authMaxDelay = 15 * time.Minute
+
+	totpStep = 30 * time.Second
+	// totpSkew is how many steps either side of the current one are
+	// accepted, allowing for clock drift.
+	totpSkew = 1
+)
+
+// AuthUser holds the second factors a client identity must present after
+// the handshake. All which are set are required.
+type AuthUser struct {
+	// TOTP is a base32 secret, as shared with an authenticator app.
+	TOTP string `json:"totp,omitempty"`
+	// Password is a bcrypt hash.
+	Password string `json:"password,omitempty"`
+
+	totpKey     []byte
+	lock        sync.Mutex
+	lastStep    int64 // of the last accepted TOTP code, so codes are not reused
+	failures    int   // consecutive wrong answers
+	lockedUntil time.Time
+}
+
+// ReadAuthUsers reads a JSON object mapping client identities to their
+// second factors.
+func ReadAuthUsers(path string) (map[string]*AuthUser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var users map[string]*AuthUser
+	if err := json.NewDecoder(f).Decode(&users); err != nil {
+		return nil, err
+	}
+	for identity, u := range users {
+		if u == nil || (u.TOTP == "" && u.Password == "") {
+			return nil, fmt.Errorf("user %q: no totp or password", identity)
+		}
+		if u.TOTP != "" {
+			secret := strings.TrimRight(strings.ToUpper(strings.Replace(u.TOTP, " ", "", -1)), "=")
+			if u.totpKey, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret); err != nil {
+				return nil, fmt.Errorf("user %q: invalid totp secret: %v", identity, err)
+			}
+		}
+		if u.Password != "" {
+			if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+				return nil, fmt.Errorf("user %q: invalid password hash: %v", identity, err)
+			}
+		}
+	}
+	return users, nil
+}
+
+func (u *AuthUser) factors() []string {
+	var out []string
+	if u.totpKey != nil {
+		out = append(out, AuthFactorTOTP)
+	}
+	if u.Password != "" {
+		out = append(out, AuthFactorPassword)
+	}
+	return out
+}
+
+// check verifies answers, unless too many have been wrong recently, and
+// delays further answers if they are wrong. Answers for the same identity are
+// checked one at a time, so the delay holds across connections.
+func (u *AuthUser) check(answers map[string]string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if wait := time.Until(u.lockedUntil); wait > 0 {
+		return fmt.Errorf("too many wrong answers, try again in %s", wait.Round(time.Second))
+	}
+	if err := u.verify(answers); err != nil {
+		u.failures++
+		u.lockedUntil = time.Now().Add(authFailureDelay(u.failures))
+		return err
+	}
+	u.failures = 0
+	return nil
+}
+
+// authFailureDelay returns how long answers are refused for after the given
+// number of consecutive wrong answers.
+func authFailureDelay(failures int) time.Duration {
+	d := authMinDelay
+	for i := 1; i < failures && d < authMaxDelay; i++ {
+		d *= 2
+	}
+	if d > authMaxDelay {
+		d = authMaxDelay
+	}
+	return d
+}
+
+// verify returns an error unless answers holds the correct value of every
+// factor. Must be called with lock held.
+func (u *AuthUser) verify(answers map[string]string) error {
+	if u.Password != "" {
+		if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(answers[AuthFactorPassword])) != nil {
+			return errors.New("wrong password")
+		}
+	}
+	if u.totpKey != nil {
+		code := strings.Replace(answers[AuthFactorTOTP], " ", "", -1)
+		now := time.Now().Unix() / int64(totpStep/time.Second)
+		for step := now - totpSkew; step <= now+totpSkew; step++ {
+			if hmac.Equal([]byte(code), []byte(totpCode(u.totpKey, step))) {
+				if step <= u.lastStep {
+					return errors.New("code already used, wait for the next one")
+				}
+				u.lastStep = step
+				return nil
+			}
+		}
+		return errors.New("wrong code")
+	}
+	return nil
+}
+
+// totpCode returns the 6 digit code for a time step (RFC 6238, with
+// HMAC-SHA1).
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+	off := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[off:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", v%1000000)
+}
+
+// Messages exchanged after the handshake, before any packets, when the
+// server requires a second factor. The server sends authChallenge, then the
+// client sends authAnswer & the server authResult until it succeeds, or the
+// server gives up.
+type authChallenge struct {
+	Factors []string
+}
+
+type authAnswer struct {
+	// Session, if set, is a session the client may resume, which proves
+	// it has already answered the challenge.
+	Session string
+	Answers map[string]string
+}
+
+type authResult struct {
+	OK bool
+	// Retry is set if the client may answer again.
+	Retry   bool
+	Message string
+}
+
+// authenticate challenges the client with identity for its second factors,
+// returning true once they are answered, or it presents a session it may
+// resume.
+func (s *Server) authenticate(c net.Conn, identity string) bool {
+	user := s.authUsers[identity]
+	if user == nil {
+		log.Printf("No second factor for %q at %s, closing connection\n", identity, c.RemoteAddr().String())
+		s.emitEvent(EventAuthFailed, identity, "no second factor configured")
+		return false
+	}
+	c.SetDeadline(time.Now().Add(authTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	encoder, decoder := gob.NewEncoder(c), gob.NewDecoder(c)
+	if err := encoder.Encode(authChallenge{Factors: user.factors()}); err != nil {
+		log.Printf("Could not send challenge to %s: %s\n", c.RemoteAddr().String(), err.Error())
+		return false
+	}
+	for failures := 0; ; {
+		var answer authAnswer
+		if err := decoder.Decode(&answer); err != nil {
+			log.Printf("Could not decode answer from %s (%q): %s\n", c.RemoteAddr().String(), identity, err.Error())
+			return false
+		}
+
+		var err error
+		switch {
+		case answer.Session != "" && s.hasSession(answer.Session, identity):
+		case len(answer.Answers) == 0:
+			err = errors.New("session expired, second factor required")
+		default:
+			if err = user.check(answer.Answers); err != nil {
+				failures++
+				log.Printf("Second factor of %q at %s rejected: %s\n", identity, c.RemoteAddr().String(), err.Error())
+				s.emitEvent(EventAuthFailed, identity, err.Error())
+			}
+		}
+		if err == nil {
+			return encoder.Encode(authResult{OK: true}) == nil
+		}
+
+		retry := failures < authAttempts
+		encoder.Encode(authResult{Retry: retry, Message: err.Error()})
+		if !retry {
+			return false
+		}
+	}
+}
+
+// hasSession returns true if session belongs to a client with identity,
+// which is connected or may still resume it.
+func (s *Server) hasSession(session, identity string) bool {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	old := s.sessions[session]
+	return old != nil && old.identity == identity && s.clients[old.id] == old
+}
+
+// authenticate answers the server's challenge over c, offering the current
+// session if there is one, else prompting on the terminal for each factor.
+func (c *Client) authenticate(tlsConn net.Conn) error {
+	tlsConn.SetDeadline(time.Now().Add(authTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+
+	encoder, decoder := gob.NewEncoder(tlsConn), gob.NewDecoder(tlsConn)
+	var challenge authChallenge
+	if err := decoder.Decode(&challenge); err != nil {
+		return errors.New("could not read challenge (no second factor configured?) - " + err.Error())
+	}
+	answer := authAnswer{Session: c.session}
+	for {
+		if answer.Session == "" {
+			answer.Answers = map[string]string{}
+			for _, f := range challenge.Factors {
+				prompt := "Password: "
+				if f == AuthFactorTOTP {
+					prompt = "Authenticator code: "
+				}
+				v, err := readSecret(prompt)
+				if err != nil {
+					return err
+				}
+				answer.Answers[f] = v
+			}
+		}
+		if err := encoder.Encode(answer); err != nil {
+			return err
+		}
+		var result authResult
+		if err := decoder.Decode(&result); err != nil {
+			return err
+		}
+		if result.OK {
+			return nil
+		}
+		if !result.Retry {
+			return errors.New("second factor rejected - " + result.Message)
+		}
+		log.Printf("Second factor rejected: %s\n", result.Message)
+		answer = authAnswer{}
+	}
+}
+
+// readSecret prompts for a line on the controlling terminal, without
+// echoing it.
+func readSecret(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", errors.New("no terminal to prompt for the second factor - " + err.Error())
+	}
+	defer tty.Close()
+
+	if stty(tty, "-echo") == nil {
+		defer func() {
+			stty(tty, "echo")
+			fmt.Fprintln(tty)
+		}()
+	}
+	fmt.Fprint(tty, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func stty(tty *os.File, arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = tty
+	return cmd.Run()
+}
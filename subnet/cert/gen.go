@@ -3,9 +3,11 @@ package cert
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"io/ioutil"
@@ -84,7 +86,9 @@ func makeBasicCert(now time.Time) *x509.Certificate {
 }
 
 // IssueClientCert mints and saves a client cert signed by the CA cert files provided.
-func IssueClientCert(CACertPath, CAKeyPath, clientCertPath, clientKeyPath string) error {
+// If commonName is not empty, it is set as the subject common name, and is used by the
+// server to identify the client.
+func IssueClientCert(CACertPath, CAKeyPath, clientCertPath, clientKeyPath, commonName string) error {
 	unsecure_rand.Seed(time.Now().Unix())
 	now := time.Now()
 
@@ -96,6 +100,7 @@ func IssueClientCert(CACertPath, CAKeyPath, clientCertPath, clientKeyPath string
 	cert.BasicConstraintsValid = true
 	cert.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
 	cert.KeyUsage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	cert.Subject.CommonName = commonName
 
 	// -- make the key --
 	key, err := GenerateRSA(2048)
@@ -133,6 +138,20 @@ func IssueClientCert(CACertPath, CAKeyPath, clientCertPath, clientKeyPath string
 	return nil
 }
 
+// Identity returns the name a client certificate is known by: its common name if
+// set, otherwise a fingerprint of its public key.
+func Identity(c *x509.Certificate) string {
+	if c.Subject.CommonName != "" {
+		return c.Subject.CommonName
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(c.PublicKey)
+	if err != nil {
+		pubKey = c.Raw
+	}
+	sum := sha256.Sum256(pubKey)
+	return hex.EncodeToString(sum[:8])
+}
+
 // MakeServerCert generates a CA+Server certificate and writes it into the specified paths.
 func MakeServerCert(serverCertPath, serverKeyPath, CACertPath, CAKeyPath string) error {
 	unsecure_rand.Seed(time.Now().Unix())
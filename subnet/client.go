@@ -1,12 +1,13 @@
 package subnet
 
 import (
+	"crypto/ecdh"
 	"crypto/tls"
 	"encoding/gob"
 	"errors"
 	"log"
 	"net"
-	"runtime"
+	"net/url"
 	"sync"
 	"time"
 
@@ -19,24 +20,54 @@ import (
 type Client struct {
 	debugMessages bool
 	newGateway    string
-	serverAddr    string
-	port          string
+
+	// servers are the addresses of the servers, in order of preference.
+	servers      []*serverAddr
+	activeServer int
+	failbackTo   int
+	// endpoints are the addresses connected to directly: the servers, or
+	// the proxy through which they are reached.
+	endpoints []*net.TCPAddr
+	dial      dialFunc
+	// wsPath, if set, is the path of a WebSocket on the servers, at which
+	// they are connected to over HTTPS rather than directly with TLS.
+	wsPath        string
+	wsBehindProxy bool
 
 	wg              sync.WaitGroup
-	serverIP        net.IP
 	localAddr       net.IP
 	additionalAddrs []net.IP
 	localNetMask    *net.IPNet
+	routes          []*net.IPNet
+	excludeRoutes   []*net.IPNet
+	killSwitch      bool
+	killSwitchLAN   bool
+	killSwitchNets  []*net.IPNet // permitted by -kill-switch-lan
+	layer2          bool
+	multicast       bool
+	dns             *DNSConfig
+	ignoreServerDNS bool
+	dnsApplied      bool
+	session         string
+	gateway         net.IP
+	gatewayDev      string
+	controlPath     string
+	control         net.Listener
+	retry           chan struct{}
 	isShuttingDown  bool
 
 	//channels between various components
-	packetsIn     chan *IPPacket
-	packetsDevOut chan *IPPacket
-
-	intf    *water.Interface
-	tlsConf *tls.Config
-	tlsConn *tls.Conn //do not use directly
-	tcpConn net.Conn
+	packetsIn     *packetQueue
+	packetsDevOut *packetQueue
+
+	intf      *water.Interface
+	tlsConf   *tls.Config
+	tlsConn   net.Conn //do not use directly
+	tcpConn   net.Conn
+	transport conn.Transport
+	// secondFactor is set if the server challenges for a second factor
+	// after the handshake.
+	secondFactor bool
 
 	// if false, packets are dropped
 	connectionOk  bool
@@ -45,28 +76,125 @@ type Client struct {
 	reverser Reverser
 }
 
-// NewClient constructs a Client object.
-func NewClient(servAddr, port, network, iName string, newGateway string,
-	certPemPath, keyPemPath, caCertPath string, additionalAddresses []net.IP) (*Client, error) {
+// ClientOptions describes optional behaviour of a Client.
+type ClientOptions struct {
+	// KernelTLS hands encryption of the tunnel stream to the kernel after
+	// the handshake, where supported.
+	KernelTLS bool
+	// ObfuscationKey, if set, disguises the connection with the obfuscated
+	// transport (see conn.ObfsTransport), keyed by it. The server must use
+	// the same key.
+	ObfuscationKey []byte
+
+	// NoiseKey & NoiseServerKey, if set, authenticate with a Noise handshake
+	// using static keys (see conn.NoiseTransport), rather than TLS &
+	// certificates. NoiseServerKey is the server's public key.
+	NoiseKey       *ecdh.PrivateKey
+	NoiseServerKey *ecdh.PublicKey
+
+	// SecondFactor answers the server's challenge for a second factor (see
+	// ServerOptions.AuthUsersPath) after the handshake, prompting on the
+	// terminal unless the session can be resumed.
+	SecondFactor bool
+
+	// Routes lists additional networks to route through the tunnel.
+	Routes []*net.IPNet
+	// ExcludeRoutes lists networks which should bypass the tunnel when the
+	// default gateway is redirected.
+	ExcludeRoutes []*net.IPNet
+
+	// KillSwitch installs firewall rules which block traffic outside the
+	// tunnel, other than traffic to the server. Linux only.
+	KillSwitch bool
+	// KillSwitchLAN additionally permits traffic to directly attached networks.
+	KillSwitchLAN bool
+
+	// DNS is used while connected, instead of any DNS configuration sent
+	// by the server.
+	DNS *DNSConfig
+	// IgnoreServerDNS leaves DNS configuration untouched unless DNS is set.
+	IgnoreServerDNS bool
+
+	// Layer2 carries ethernet frames over a TAP device rather than IP
+	// packets over a TUN device. The server must also be in layer 2 mode.
+	Layer2 bool
+
+	// Multicast sends multicast packets to the server, for replication to
+	// other clients. The server must also have multicast enabled.
+	Multicast bool
+
+	// ServerSelection is how servers are preferred when several are given:
+	// ServerSelectionPriority (the default) or ServerSelectionLatency.
+	ServerSelection string
+
+	// WebSocketPath, if set, is the path of a WebSocket at which the servers
+	// are connected to over HTTPS, rather than directly with TLS.
+	WebSocketPath string
+	// WebSocketBehindProxy accepts a certificate valid for the server's host
+	// name under the system's roots, from a reverse proxy terminating TLS.
+	WebSocketBehindProxy bool
+
+	// Proxy, if set, is an HTTP or SOCKS5 proxy (see ParseProxy) through
+	// which to connect to the servers.
+	Proxy *url.URL
+
+	// ControlPath is the path of a unix socket accepting commands, such as
+	// "retry" to reconnect immediately.
+	ControlPath string
+
+	// ServerName is sent to the server during the TLS handshake (SNI), to
+	// select a tenant of a multi-tenant server.
+	ServerName string
+
+	// JournalPath is where changes to network configuration are recorded,
+	// so they can be undone after an unclean exit.
+	JournalPath string
+}
 
-	tlsConf, err := conn.TLSConfig(certPemPath, keyPemPath, caCertPath)
-	if err != nil {
-		return nil, err
+// NewClient constructs a Client object. servAddr is a comma-separated list of
+// servers (each optionally host:port), which are failed over between.
+func NewClient(servAddr, port, network, iName string, newGateway string,
+	certPemPath, keyPemPath, caCertPath string, additionalAddresses []net.IP, opts ClientOptions) (*Client, error) {
+
+	var tlsConf *tls.Config
+	var transport conn.Transport
+	if opts.NoiseKey != nil {
+		transport = &conn.NoiseTransport{Key: opts.NoiseKey, RemoteKey: opts.NoiseServerKey}
+	} else {
+		var err error
+		if tlsConf, err = conn.TLSConfig(certPemPath, keyPemPath, caCertPath); err != nil {
+			return nil, err
+		}
+		tlsConf.ServerName = opts.ServerName
+		// Allow abbreviated handshakes when reconnecting.
+		tlsConf.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		transport = &conn.TLSTransport{Config: tlsConf, KernelTLS: opts.KernelTLS}
 	}
 
-	serverIP, err := hostToIP(servAddr)
+	// Through a proxy, server names are resolved by the proxy, and only the
+	// proxy is connected to directly, so it must bypass the tunnel.
+	servers, endpoints, err := resolveServers(servAddr, port, opts.Proxy == nil)
 	if err != nil {
 		return nil, err
 	}
+	if opts.Proxy != nil {
+		if _, endpoints, err = resolveServers(opts.Proxy.Host, "", true); err != nil {
+			return nil, errors.New("could not resolve proxy - " + err.Error())
+		}
+	}
+	dial := proxyDialer(opts.Proxy)
+	if opts.ServerSelection == ServerSelectionLatency {
+		orderByLatency(servers, dial)
+	}
 
 	netIP, localNetMask, err := net.ParseCIDR(network)
 	if err != nil {
 		return nil, errors.New("invalid network address/mask - " + err.Error())
 	}
 
-	intf, err := water.NewTUN(iName)
+	intf, err := newDevice(iName, opts.Layer2)
 	if err != nil {
-		return nil, errors.New("Could not create TUN - " + err.Error())
+		return nil, err
 	}
 
 	log.Printf("Created iface %s\n", intf.Name())
@@ -75,86 +203,161 @@ func NewClient(servAddr, port, network, iName string, newGateway string,
 		debugMessages:   false,
 		intf:            intf,
 		newGateway:      newGateway,
-		serverAddr:      servAddr,
-		port:            port,
+		servers:         servers,
+		wsPath:          opts.WebSocketPath,
+		wsBehindProxy:   opts.WebSocketBehindProxy,
+		endpoints:       endpoints,
+		dial:            dial,
+		failbackTo:      -1,
+		controlPath:     opts.ControlPath,
+		retry:           make(chan struct{}, 1),
 		localAddr:       netIP,
 		localNetMask:    localNetMask,
-		serverIP:        serverIP,
 		tlsConf:         tlsConf,
-		packetsIn:       make(chan *IPPacket, pktInMaxBuff),
-		packetsDevOut:   make(chan *IPPacket, pktOutMaxBuff),
+		packetsIn:       newPacketQueue(pktInMaxBuff, opts.Layer2),
+		packetsDevOut:   newPacketQueue(pktOutMaxBuff, opts.Layer2),
 		additionalAddrs: additionalAddresses,
+		transport:       obfuscate(transport, opts.ObfuscationKey, nil),
+		secondFactor:    opts.SecondFactor,
+		routes:          opts.Routes,
+		excludeRoutes:   opts.ExcludeRoutes,
+		killSwitch:      opts.KillSwitch,
+		killSwitchLAN:   opts.KillSwitchLAN,
+		layer2:          opts.Layer2,
+		multicast:       opts.Multicast,
+		dns:             opts.DNS,
+		ignoreServerDNS: opts.IgnoreServerDNS,
+		reverser:        Reverser{JournalPath: opts.JournalPath},
 	}
 
-	return ret, ret.init(servAddr, port)
+	return ret, ret.init()
 }
 
 // Initializes connection and changes network configuration as needed, but does not
 // activate the client object for use.
-func (c *Client) init(serverAddr, port string) error {
-	tcpConn, err := net.Dial("tcp", serverAddr+":"+port)
-	if err != nil {
+func (c *Client) init() error {
+	if err := c.connect(); err != nil {
 		return err
 	}
-	tcpConn.(*net.TCPConn).SetKeepAlivePeriod(60 * time.Second)
-	tcpConn.(*net.TCPConn).SetKeepAlive(true)
-	c.tcpConn = tcpConn
-
-	c.tlsConn = tls.Client(tcpConn, c.tlsConf)
+	c.connectionOk = true
 
-	if err := c.tlsConn.Handshake(); err != nil {
+	if err := SetDevIP(c.intf.Name(), c.localAddr, c.localNetMask, c.debugMessages); err != nil {
 		return err
 	}
+	log.Printf("IP of %s set to %s, localNetMask %s\n", c.intf.Name(), c.localAddr.String(), net.IP(c.localNetMask.Mask).String())
 
-	c.connectionOk = true
+	if c.killSwitch {
+		if err := c.enableKillSwitch(); err != nil {
+			return errors.New("could not enable kill switch - " + err.Error())
+		}
+	}
 
-	if err := SetDevIP(c.intf.Name(), c.localAddr, c.localNetMask, c.debugMessages); err != nil {
+	// get default gateway information, to notice when it changes
+	gw, gatewayDevice, err := GetNetGateway()
+	if err != nil && c.newGateway != "" {
 		return err
 	}
-	log.Printf("IP of %s set to %s, localNetMask %s\n", c.intf.Name(), c.localAddr.String(), net.IP(c.localNetMask.Mask).String())
+	c.gateway, c.gatewayDev = net.ParseIP(gw), gatewayDevice
 
 	if c.newGateway != "" {
-		// get default gateway information
-		gw, gatewayDevice, err := GetNetGateway()
-		if err != nil {
-			return err
+		log.Printf("Default gateway is %s on %s\n", c.gateway, gatewayDevice)
+		for _, n := range c.bypassRoutes() {
+			if err := c.reverser.AddRoute(n, c.gateway, gatewayDevice, c.debugMessages); err != nil {
+				return err
+			}
+			log.Printf("Traffic to %s now routed via %s on %s.\n", n, gw, gatewayDevice)
 		}
-		gateway := net.ParseIP(gw)
-		log.Printf("Default gateway is %s on %s\n", gateway, gatewayDevice)
+	}
 
-		// route all traffic to the VPN server through the current gateway device
-		if err := AddRoute(c.serverIP, gateway, gatewayDevice, c.debugMessages); err != nil {
-			return err
+	return nil
+}
+
+// bypassRoutes returns the networks routed via the existing default gateway
+// rather than the tunnel when -gw is set: the servers (or proxy), so the
+// client can fail over (and back) between them, and excluded networks.
+func (c *Client) bypassRoutes() []*net.IPNet {
+	var out []*net.IPNet
+	routed := map[string]bool{}
+	for _, server := range c.endpoints {
+		if !routed[server.IP.String()] {
+			routed[server.IP.String()] = true
+			out = append(out, hostNet(server.IP))
 		}
-		log.Printf("Traffic to %s now routed via %s on %s.\n", c.serverIP.String(), gw, gatewayDevice)
-		c.reverser.AddRouteEntry(c.serverIP, gateway, gatewayDevice)
-		if runtime.GOOS == "darwin" {
-			c.reverser.ResetGatewayOSX(c.intf, gw)
+	}
+	return append(out, c.excludeRoutes...)
+}
+
+// enableKillSwitch blocks all traffic which does not go through the tunnel,
+// other than connections to the servers. The rules remain in place while
+// reconnecting, and are only removed when the client is closed.
+func (c *Client) enableKillSwitch() error {
+	var allow []*net.IPNet
+	var err error
+	if c.killSwitchLAN {
+		if allow, err = localNetworks(c.intf.Name()); err != nil {
+			return err
 		}
 	}
 
+	if err := c.reverser.EnableKillSwitch(c.intf.Name(), c.endpoints, allow, c.debugMessages); err != nil {
+		return err
+	}
+	c.killSwitchNets = allow
+	log.Printf("Kill switch enabled: only traffic via %s or to %s is permitted.\n", c.intf.Name(), c.endpoints)
+	for _, n := range allow {
+		log.Printf("Kill switch permits traffic to %s.\n", n)
+	}
 	return nil
 }
 
 // Run starts the client.
 func (c *Client) Run() {
+	err := SetInterfaceStatus(c.intf.Name(), true, c.debugMessages)
+	if err != nil {
+		log.Printf("Could not bring up interface %s: %s\n", c.intf.Name(), err.Error())
+		return
+	}
 
-	if c.newGateway != "" { //Redirect default traffic via our VPN
-		err := SetDefaultGateway(c.newGateway, c.intf.Name(), c.debugMessages)
-		if err != nil {
-			log.Printf("Could set gateway: %s\n", err.Error())
+	routes := c.routes
+	if c.newGateway != "" {
+		// Redirect default traffic via our VPN, using two routes which are more specific
+		// than the default route - so the default route never needs to be changed.
+		routes = append(routes, fullTunnelRoutes...)
+	}
+	// A TUN device has no link layer, so routes point directly at it. On a TAP
+	// device, traffic needs to be addressed to the gateway on the remote segment.
+	var via net.IP
+	if c.layer2 && c.newGateway != "" {
+		via = net.ParseIP(c.newGateway)
+	}
+	for _, route := range routes {
+		if err := c.reverser.AddRoute(route, via, c.intf.Name(), c.debugMessages); err != nil {
+			log.Printf("Could not route %s via %s: %s\n", route, c.intf.Name(), err.Error())
 			return
 		}
+		log.Printf("Traffic to %s now routed via %s.\n", route, c.intf.Name())
 	}
 
-	err := SetInterfaceStatus(c.intf.Name(), true, c.debugMessages)
-	if err != nil {
-		log.Printf("Could not bring up interface %s: %s\n", c.intf.Name(), err.Error())
-		return
+	if !c.dns.Empty() {
+		c.setDNS(c.dns)
 	}
 
 	go c.netSendRoutine()
 	go c.netRecvRoutine()
+	if len(c.servers) > 1 {
+		go c.failbackRoutine()
+	}
+	changes := make(chan struct{}, 1)
+	if err := watchNetwork(changes, &c.isShuttingDown); err != nil {
+		log.Printf("Could not watch for network changes: %s\n", err.Error())
+	} else {
+		go c.roamRoutine(changes)
+	}
+	if c.controlPath != "" {
+		if err := c.serveControl(c.controlPath); err != nil {
+			log.Printf("Could not create control socket %s: %s\n", c.controlPath, err.Error())
+		}
+	}
 	go devReadRoutine(c.intf, c.packetsIn, &c.wg, &c.isShuttingDown)
 	go devWriteRoutine(c.intf, c.packetsDevOut, &c.wg, &c.isShuttingDown)
 }
@@ -164,24 +367,33 @@ func (c *Client) netSendRoutine() {
 	defer c.wg.Done()
 
 	for !c.isShuttingDown {
-		encoder := gob.NewEncoder(c.tlsConn)
+		tlsConn := c.tlsConn
+		encoder := gob.NewEncoder(tlsConn)
 		connOK := c.connectionOk
 		if connOK {
+			if c.session != "" {
+				// Reclaim our routes, and packets buffered while disconnected.
+				encoder.Encode(conn.PktResume)
+				encoder.Encode(c.session)
+			}
 			c.sendLocalAddr(encoder)
 		}
 
 		for c.connectionOk && connOK {
-			pkt, ok := <-c.packetsIn
+			pkt, ok := c.packetsIn.Dequeue()
 			if !ok {
 				break
 			}
+			if pkt == nil || c.tlsConn != tlsConn {
+				break // reconnected while waiting for a packet
+			}
 
-			if pkt.Dest.IsMulticast() { //Don't forward multicast
+			if pkt.Dest.IsMulticast() && !c.multicast { //Don't forward multicast
 				continue
 			}
 
 			//log.Printf("Msg: %v", pkt.Dest)
-			err := encoder.Encode(conn.PktIPPkt)
+			err := encoder.Encode(c.dataPktType())
 			if err != nil {
 				log.Println("Encode error: ", err)
 				c.connectionProblem()
@@ -195,17 +407,7 @@ func (c *Client) netSendRoutine() {
 			}
 		}
 		time.Sleep(time.Millisecond * 150)
-		dropSendBuffer(c.packetsIn)
-	}
-}
-
-func dropSendBuffer(buffer chan *IPPacket) {
-	for {
-		select {
-		case <-buffer:
-		default:
-			return
-		}
+		c.packetsIn.Flush()
 	}
 }
 
@@ -232,7 +434,7 @@ func (c *Client) netRecvRoutine() {
 			switch pktType {
 			default:
 				log.Println("Got unexpected packet type: ", pktType)
-			case conn.PktIPPkt:
+			case conn.PktIPPkt, conn.PktEthFrame:
 				var ipPkt IPPacket
 				err := decoder.Decode(&ipPkt)
 				if err != nil {
@@ -241,7 +443,24 @@ func (c *Client) netRecvRoutine() {
 					break
 				}
 				//log.Printf("[NET] Packet Received: dest %s, len %d\n", ipPkt.Dest.String(), len(ipPkt.Raw))
-				c.packetsDevOut <- &ipPkt
+				c.packetsDevOut.Enqueue(&ipPkt)
+			case conn.PktSession:
+				if err := decoder.Decode(&c.session); err != nil {
+					log.Printf("Could not decode session: %s", err.Error())
+					c.connectionProblem()
+					break
+				}
+			case conn.PktDNSConfig:
+				var dnsConf DNSConfig
+				err := decoder.Decode(&dnsConf)
+				if err != nil {
+					log.Printf("Could not decode DNSConfig: %s", err.Error())
+					c.connectionProblem()
+					break
+				}
+				if c.dns == nil && !c.ignoreServerDNS {
+					c.setDNS(&dnsConf)
+				}
 			}
 		}
 		time.Sleep(time.Millisecond * 150)
@@ -266,28 +485,77 @@ func (c *Client) connectionProblem() {
 		time.Sleep(time.Second)
 
 		for i := 0; true; i++ {
-			tcpConn, err := net.Dial("tcp", c.serverAddr+":"+c.port)
-
-			if err == nil {
-				tcpConn.(*net.TCPConn).SetKeepAlivePeriod(60 * time.Second)
-				tcpConn.(*net.TCPConn).SetKeepAlive(true)
-				c.tcpConn = tcpConn
-				c.tlsConn = tls.Client(tcpConn, c.tlsConf)
-				err = c.tlsConn.Handshake()
-			}
-
+			err := c.reconnect(i)
 			if err == nil {
 				c.connectionOk = true
 				log.Println("Connection re-established.")
+				c.packetsIn.Wake() // resume the session without waiting for a packet
 				break
 			} else {
-				log.Printf("Reconnect failure: %s. Retrying in %d seconds.\n", err.Error(), i*i*5)
-				time.Sleep(time.Second * time.Duration(i*i*5))
+				delay := reconnectDelay(i)
+				log.Printf("Reconnect failure: %s. Retrying in %s.\n", err.Error(), delay.Round(time.Second))
+				c.waitRetry(delay)
 			}
 		}
 	}
 }
 
+// dataPktType returns the type of packet carrying tunnelled traffic.
+func (c *Client) dataPktType() conn.PktType {
+	if c.layer2 {
+		return conn.PktEthFrame
+	}
+	return conn.PktIPPkt
+}
+
+// setDNS configures the system to use the given DNS configuration, unless
+// it has already been configured.
+func (c *Client) setDNS(dnsConf *DNSConfig) {
+	if c.dnsApplied || dnsConf.Empty() {
+		return
+	}
+	if err := c.reverser.SetDNS(c.intf.Name(), dnsConf, c.newGateway != "", c.debugMessages); err != nil {
+		log.Printf("Could not configure DNS: %s\n", err.Error())
+		return
+	}
+	c.dnsApplied = true
+	log.Printf("DNS configured: %s\n", dnsConf)
+}
+
+// connectTo dials the server at index i of c.servers and performs the
+// transport's handshake, making it the active server.
+func (c *Client) connectTo(i int) error {
+	tcpConn, err := c.dial(c.servers[i].String(), probeTimeout)
+	if err != nil {
+		return err
+	}
+	tcpConn.(*net.TCPConn).SetKeepAlivePeriod(60 * time.Second)
+	tcpConn.(*net.TCPConn).SetKeepAlive(true)
+	c.tcpConn = tcpConn
+
+	var tlsConn net.Conn
+	if c.wsPath != "" {
+		tlsConn, err = c.dialWebSocket(tcpConn, c.servers[i])
+	} else {
+		tlsConn, err = c.transport.Client(tcpConn)
+	}
+	if err != nil {
+		return err
+	}
+	if c.secondFactor {
+		if err := c.authenticate(tlsConn); err != nil {
+			tlsConn.Close()
+			return err
+		}
+	}
+	c.tlsConn = tlsConn
+	if i != c.activeServer {
+		log.Printf("Now connected to server %s.\n", c.servers[i])
+	}
+	c.activeServer = i
+	return nil
+}
+
 func (c *Client) sendLocalAddr(encoder *gob.Encoder) error {
 	err := encoder.Encode(conn.PktLocalAddr)
 	if err != nil {
@@ -310,11 +578,24 @@ func (c *Client) sendLocalAddr(encoder *gob.Encoder) error {
 	return nil
 }
 
+// QueueStats returns statistics about the packets queued in each direction.
+func (c *Client) QueueStats() map[string]QueueStats {
+	return map[string]QueueStats{
+		"to-server":           c.packetsIn.Stats(),
+		"to-" + c.intf.Name(): c.packetsDevOut.Stats(),
+	}
+}
+
 // Close shuts down the client, reversing configuration changes to the system.
 func (c *Client) Close() error {
 	c.isShuttingDown = true
+	if c.control != nil {
+		c.control.Close()
+	}
 	c.reverser.Close()
 	c.tlsConn.Close()
+	c.packetsIn.Close()
+	c.packetsDevOut.Close()
 	e := c.intf.Close()
 	if e != nil {
 		return e
@@ -0,0 +1,58 @@
+package conn
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// ALPNProtocol is the application protocol negotiated by subnet clients &
+// servers, which identifies VPN connections sharing a port with other TLS
+// services.
+const ALPNProtocol = "subnet"
+
+const helloTimeout = 10 * time.Second
+
+var errHelloRead = errors.New("ClientHello read")
+
+// PeekClientHello reads the TLS ClientHello at the start of c, returning its
+// server name & protocols, and a connection which replays the bytes read.
+func PeekClientHello(c net.Conn) (net.Conn, *tls.ClientHelloInfo, error) {
+	var buf bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	c.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	// Let crypto/tls parse the ClientHello, aborting the handshake after.
+	err := tls.Server(&readOnlyConn{Conn: c, r: io.TeeReader(c, &buf)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &tls.ClientHelloInfo{ServerName: h.ServerName, SupportedProtos: h.SupportedProtos}
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	peeked := &prefixConn{Conn: c, r: io.MultiReader(&buf, c)}
+	if hello == nil {
+		return peeked, nil, err
+	}
+	return peeked, hello, nil
+}
+
+// readOnlyConn reads from r, discarding writes.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// prefixConn reads from r, which replays bytes already read from Conn.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) { return c.r.Read(b) }
@@ -0,0 +1,172 @@
+package conn
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Constants from linux/tls.h & linux/tcp.h.
+const (
+	solTLS = 282
+	tcpULP = 31
+
+	tlsTX = 1
+	tlsRX = 2
+
+	tls13Version = 0x0304
+
+	tlsCipherAESGCM128        = 51
+	tlsCipherAESGCM256        = 52
+	tlsCipherChaCha20Poly1305 = 54
+)
+
+// ktlsConn reads and/or writes plaintext through a socket with kTLS enabled.
+// If only one direction could be offloaded, the other is serviced by crypto/tls.
+type ktlsConn struct {
+	net.Conn
+	r     io.Reader
+	w     io.Writer
+	state tls.ConnectionState
+}
+
+func (c *ktlsConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *ktlsConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+// ConnectionState returns the state of the TLS session negotiated before offload.
+func (c *ktlsConn) ConnectionState() tls.ConnectionState { return c.state }
+
+// offloadTLS hands the TLS 1.3 application traffic secrets of tlsConn to the kernel.
+func offloadTLS(tlsConn *tls.Conn, rawConn net.Conn, keys *keyLog, isClient bool) (net.Conn, error) {
+	tcpConn, ok := rawConn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("kTLS requires a TCP connection")
+	}
+	state := tlsConn.ConnectionState()
+	if state.Version != tls.VersionTLS13 {
+		return nil, fmt.Errorf("unsupported TLS version %x", state.Version)
+	}
+
+	clientInfo, err := ktlsCryptoInfo(state.CipherSuite, keys.secret("CLIENT_TRAFFIC_SECRET_0"))
+	if err != nil {
+		return nil, err
+	}
+	serverInfo, err := ktlsCryptoInfo(state.CipherSuite, keys.secret("SERVER_TRAFFIC_SECRET_0"))
+	if err != nil {
+		return nil, err
+	}
+	txInfo, rxInfo := serverInfo, clientInfo
+	if isClient {
+		txInfo, rxInfo = clientInfo, serverInfo
+	}
+
+	rc, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ulpErr, txErr, rxErr error
+	err = rc.Control(func(fd uintptr) {
+		if ulpErr = syscall.SetsockoptString(int(fd), syscall.SOL_TCP, tcpULP, "tls"); ulpErr != nil {
+			return
+		}
+		txErr = setsockoptBytes(int(fd), solTLS, tlsTX, txInfo)
+		rxErr = setsockoptBytes(int(fd), solTLS, tlsRX, rxInfo)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ulpErr != nil {
+		return nil, fmt.Errorf("setting TLS ULP: %v", ulpErr)
+	}
+	if txErr != nil && rxErr != nil {
+		return nil, fmt.Errorf("setting TLS_TX: %v, TLS_RX: %v", txErr, rxErr)
+	}
+
+	c := &ktlsConn{Conn: tcpConn, r: tcpConn, w: tcpConn, state: state}
+	if txErr != nil {
+		c.w = tlsConn
+	}
+	if rxErr != nil {
+		c.r = tlsConn
+	}
+	return c, nil
+}
+
+// ktlsCryptoInfo derives the record key & IV from a TLS 1.3 traffic secret,
+// and returns them serialized as the matching tls12_crypto_info_* structure.
+func ktlsCryptoInfo(suite uint16, secret []byte) ([]byte, error) {
+	if secret == nil {
+		return nil, errors.New("traffic secret not available")
+	}
+
+	var cipherType uint16
+	var keyLen int
+	var h func() hash.Hash
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		cipherType, keyLen, h = tlsCipherAESGCM128, 16, sha256.New
+	case tls.TLS_AES_256_GCM_SHA384:
+		cipherType, keyLen, h = tlsCipherAESGCM256, 32, sha512.New384
+	case tls.TLS_CHACHA20_POLY1305_SHA256:
+		cipherType, keyLen, h = tlsCipherChaCha20Poly1305, 32, sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported cipher suite %s", tls.CipherSuiteName(suite))
+	}
+
+	key, err := hkdfExpandLabel(h, secret, "key", keyLen)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hkdfExpandLabel(h, secret, "iv", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	info := make([]byte, 4, 4+len(iv)+keyLen+8)
+	binary.LittleEndian.PutUint16(info[0:2], tls13Version)
+	binary.LittleEndian.PutUint16(info[2:4], cipherType)
+	if cipherType == tlsCipherChaCha20Poly1305 {
+		// iv[12], key[32], rec_seq[8]
+		info = append(info, iv...)
+		info = append(info, key...)
+	} else {
+		// iv[8], key[16|32], salt[4], rec_seq[8]
+		info = append(info, iv[4:]...)
+		info = append(info, key...)
+		info = append(info, iv[:4]...)
+	}
+	// No records have been sent with the application traffic keys yet.
+	return append(info, make([]byte, 8)...), nil
+}
+
+// hkdfExpandLabel implements HKDF-Expand-Label from RFC 8446, section 7.1.
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) ([]byte, error) {
+	label = "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0) // empty context
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(h, secret, info), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func setsockoptBytes(fd, level, opt int, b []byte) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
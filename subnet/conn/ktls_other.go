@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package conn
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+func offloadTLS(tlsConn *tls.Conn, rawConn net.Conn, keys *keyLog, isClient bool) (net.Conn, error) {
+	return nil, errors.New("kTLS is only supported on linux")
+}
@@ -0,0 +1,444 @@
+package conn
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	noiseProtocol = "Noise_IK_25519_AESGCM_SHA256"
+	noisePrologue = "subnet"
+
+	noiseMaxMessage       = 0xffff
+	noiseTagLen           = 16
+	noiseHandshakeTimeout = 15 * time.Second
+)
+
+var errNoiseDecrypt = errors.New("noise: message authentication failed")
+
+// GenerateNoiseKey returns a new static Curve25519 key.
+func GenerateNoiseKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// EncodeNoiseKey returns the base64 encoding of a private or public key.
+func EncodeNoiseKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// ParseNoisePrivateKey decodes a base64 encoded private key.
+func ParseNoisePrivateKey(s string) (*ecdh.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.New("invalid key - " + err.Error())
+	}
+	return ecdh.X25519().NewPrivateKey(b)
+}
+
+// ParseNoisePublicKey decodes a base64 encoded public key.
+func ParseNoisePublicKey(s string) (*ecdh.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.New("invalid key - " + err.Error())
+	}
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+// LoadNoiseKey reads a base64 encoded private key from a file.
+func LoadNoiseKey(path string) (*ecdh.PrivateKey, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseNoisePrivateKey(string(d))
+}
+
+// NoiseTransport authenticates both sides by their static Curve25519 keys
+// with a Noise IK handshake (Noise_IK_25519_AESGCM_SHA256), rather than with
+// TLS & certificates. The client must know the server's public key, and the
+// server learns the client's during the handshake.
+type NoiseTransport struct {
+	Key *ecdh.PrivateKey
+	// RemoteKey is the server's public key. Clients only.
+	RemoteKey *ecdh.PublicKey
+	// Authorize returns the name of the client with the given public key,
+	// or false if it may not connect. Servers only.
+	Authorize func(key *ecdh.PublicKey) (string, bool)
+
+	lock   sync.Mutex
+	latest map[string]uint64 // newest handshake timestamp by client key
+}
+
+// Client implements Transport.
+func (t *NoiseTransport) Client(rawConn net.Conn) (net.Conn, error) {
+	c, err := t.clientHandshake(rawConn)
+	if err != nil {
+		rawConn.Close()
+	}
+	return c, err
+}
+
+// Server implements Transport.
+func (t *NoiseTransport) Server(rawConn net.Conn) (net.Conn, error) {
+	c, err := t.serverHandshake(rawConn)
+	if err != nil {
+		rawConn.Close()
+	}
+	return c, err
+}
+
+func (t *NoiseTransport) clientHandshake(rawConn net.Conn) (net.Conn, error) {
+	rawConn.SetDeadline(time.Now().Add(noiseHandshakeTimeout))
+	defer rawConn.SetDeadline(time.Time{})
+	hs := newNoiseHandshake([]byte(noisePrologue), t.RemoteKey)
+
+	// The initiation carries a timestamp, so it cannot be replayed.
+	e, err := GenerateNoiseKey()
+	if err != nil {
+		return nil, err
+	}
+	msg, err := hs.writeInitiation(e, t.Key, t.RemoteKey, binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())))
+	if err != nil {
+		return nil, err
+	}
+	if err := writeNoiseMessage(rawConn, msg); err != nil {
+		return nil, err
+	}
+
+	msg, err = readNoiseMessage(rawConn)
+	if err == io.EOF {
+		return nil, errors.New("noise: server closed the connection (unknown client key?)")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := hs.readResponse(e, t.Key, msg); err != nil {
+		return nil, err
+	}
+
+	send, recv := hs.split()
+	return &noiseConn{Conn: rawConn, send: send, recv: recv}, nil
+}
+
+func (t *NoiseTransport) serverHandshake(rawConn net.Conn) (net.Conn, error) {
+	rawConn.SetDeadline(time.Now().Add(noiseHandshakeTimeout))
+	defer rawConn.SetDeadline(time.Time{})
+	hs := newNoiseHandshake([]byte(noisePrologue), t.Key.PublicKey())
+
+	msg, err := readNoiseMessage(rawConn)
+	if err != nil {
+		return nil, err
+	}
+	re, rs, payload, err := hs.readInitiation(t.Key, msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) != 8 {
+		return nil, errors.New("noise: client did not prove its key")
+	}
+	name, ok := t.Authorize(rs)
+	if !ok {
+		return nil, errors.New("noise: unknown client key " + EncodeNoiseKey(rs.Bytes()))
+	}
+	if !t.checkTimestamp(rs.Bytes(), binary.BigEndian.Uint64(payload)) {
+		return nil, errors.New("noise: replayed handshake from " + name)
+	}
+
+	e, err := GenerateNoiseKey()
+	if err != nil {
+		return nil, err
+	}
+	if msg, err = hs.writeResponse(e, re, rs, nil); err != nil {
+		return nil, err
+	}
+	if err := writeNoiseMessage(rawConn, msg); err != nil {
+		return nil, err
+	}
+
+	recv, send := hs.split()
+	return &noiseConn{Conn: rawConn, peer: name, send: send, recv: recv}, nil
+}
+
+// checkTimestamp returns true if ts is newer than any handshake before it
+// from the client with key.
+func (t *NoiseTransport) checkTimestamp(key []byte, ts uint64) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.latest == nil {
+		t.latest = map[string]uint64{}
+	}
+	if ts <= t.latest[string(key)] {
+		return false
+	}
+	t.latest[string(key)] = ts
+	return true
+}
+
+// PeerName returns the name a Noise client was authorized as, or "" if c is
+// not a Noise connection accepted by a server.
+func PeerName(c net.Conn) string {
+	if n, ok := c.(*noiseConn); ok {
+		return n.peer
+	}
+	return ""
+}
+
+// noiseHandshake is the symmetric state of a handshake, as described by the
+// Noise specification.
+type noiseHandshake struct {
+	ck, h []byte
+	k     *noiseCipher // nil until the first DH
+}
+
+func newNoiseHandshake(prologue []byte, responderKey *ecdh.PublicKey) *noiseHandshake {
+	h := make([]byte, sha256.Size)
+	copy(h, noiseProtocol)
+	hs := &noiseHandshake{ck: append([]byte(nil), h...), h: h}
+	hs.mixHash(prologue)
+	hs.mixHash(responderKey.Bytes()) // pre-message: <- s
+	return hs
+}
+
+// writeInitiation returns the initiator's message: -> e, es, s, ss.
+func (hs *noiseHandshake) writeInitiation(e, s *ecdh.PrivateKey, rs *ecdh.PublicKey, payload []byte) ([]byte, error) {
+	msg := hs.writeEphemeral(e)
+	if err := hs.mixDH(e, rs); err != nil {
+		return nil, err
+	}
+	msg = append(msg, hs.encryptAndHash(s.PublicKey().Bytes())...)
+	if err := hs.mixDH(s, rs); err != nil {
+		return nil, err
+	}
+	return append(msg, hs.encryptAndHash(payload)...), nil
+}
+
+// readInitiation reads the initiator's message with the responder's static
+// key s, returning the initiator's ephemeral & static keys, and the payload.
+func (hs *noiseHandshake) readInitiation(s *ecdh.PrivateKey, msg []byte) (*ecdh.PublicKey, *ecdh.PublicKey, []byte, error) {
+	re, err := hs.readEphemeral(msg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := hs.mixDH(s, re); err != nil {
+		return nil, nil, nil, err
+	}
+	if len(msg) < 32+32+noiseTagLen {
+		return nil, nil, nil, errors.New("noise: short handshake message")
+	}
+	rsBytes, err := hs.decryptAndHash(msg[32 : 32+32+noiseTagLen])
+	if err != nil {
+		return nil, nil, nil, errors.New("noise: client used another server key")
+	}
+	rs, err := ecdh.X25519().NewPublicKey(rsBytes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := hs.mixDH(s, rs); err != nil {
+		return nil, nil, nil, err
+	}
+	payload, err := hs.decryptAndHash(msg[32+32+noiseTagLen:])
+	if err != nil {
+		return nil, nil, nil, errors.New("noise: client did not prove its key")
+	}
+	return re, rs, payload, nil
+}
+
+// writeResponse returns the responder's message: <- e, ee, se.
+func (hs *noiseHandshake) writeResponse(e *ecdh.PrivateKey, re, rs *ecdh.PublicKey, payload []byte) ([]byte, error) {
+	msg := hs.writeEphemeral(e)
+	if err := hs.mixDH(e, re); err != nil {
+		return nil, err
+	}
+	if err := hs.mixDH(e, rs); err != nil {
+		return nil, err
+	}
+	return append(msg, hs.encryptAndHash(payload)...), nil
+}
+
+// readResponse reads the responder's message with the initiator's ephemeral
+// & static keys, returning the payload.
+func (hs *noiseHandshake) readResponse(e, s *ecdh.PrivateKey, msg []byte) ([]byte, error) {
+	re, err := hs.readEphemeral(msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := hs.mixDH(e, re); err != nil {
+		return nil, err
+	}
+	if err := hs.mixDH(s, re); err != nil {
+		return nil, err
+	}
+	payload, err := hs.decryptAndHash(msg[32:])
+	if err != nil {
+		return nil, errors.New("noise: server did not prove its key")
+	}
+	return payload, nil
+}
+
+func (hs *noiseHandshake) mixHash(data []byte) {
+	d := sha256.New()
+	d.Write(hs.h)
+	d.Write(data)
+	hs.h = d.Sum(nil)
+}
+
+func (hs *noiseHandshake) mixDH(priv *ecdh.PrivateKey, pub *ecdh.PublicKey) error {
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	var k []byte
+	hs.ck, k = noiseHKDF(hs.ck, secret)
+	hs.k, err = newNoiseCipher(k)
+	return err
+}
+
+func (hs *noiseHandshake) writeEphemeral(e *ecdh.PrivateKey) []byte {
+	pub := e.PublicKey().Bytes()
+	hs.mixHash(pub)
+	return pub
+}
+
+func (hs *noiseHandshake) readEphemeral(msg []byte) (*ecdh.PublicKey, error) {
+	if len(msg) < 32 {
+		return nil, errors.New("noise: short handshake message")
+	}
+	hs.mixHash(msg[:32])
+	return ecdh.X25519().NewPublicKey(msg[:32])
+}
+
+func (hs *noiseHandshake) encryptAndHash(plaintext []byte) []byte {
+	ct := hs.k.aead.Seal(nil, hs.k.nonce(), plaintext, hs.h)
+	hs.mixHash(ct)
+	return ct
+}
+
+func (hs *noiseHandshake) decryptAndHash(ct []byte) ([]byte, error) {
+	plaintext, err := hs.k.aead.Open(nil, hs.k.nonce(), ct, hs.h)
+	if err != nil {
+		return nil, errNoiseDecrypt
+	}
+	hs.mixHash(ct)
+	return plaintext, nil
+}
+
+// split returns the ciphers for messages from the initiator (client), and
+// from the responder (server).
+func (hs *noiseHandshake) split() (*noiseCipher, *noiseCipher) {
+	k1, k2 := noiseHKDF(hs.ck, nil)
+	c1, _ := newNoiseCipher(k1)
+	c2, _ := newNoiseCipher(k2)
+	return c1, c2
+}
+
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	mac := func(key, data []byte) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write(data)
+		return h.Sum(nil)
+	}
+	temp := mac(ck, ikm)
+	out1 := mac(temp, []byte{1})
+	out2 := mac(temp, append(append([]byte(nil), out1...), 2))
+	return out1, out2
+}
+
+// noiseCipher is a key and its nonce counter.
+type noiseCipher struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newNoiseCipher(k []byte) (*noiseCipher, error) {
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &noiseCipher{aead: aead}, nil
+}
+
+func (c *noiseCipher) nonce() []byte {
+	n := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(n[4:], c.n)
+	c.n++
+	return n
+}
+
+func writeNoiseMessage(w io.Writer, msg []byte) error {
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+func readNoiseMessage(r io.Reader) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// noiseConn carries a stream in Noise transport messages.
+type noiseConn struct {
+	net.Conn
+	peer       string
+	send, recv *noiseCipher
+
+	readBuf   []byte
+	writeLock sync.Mutex
+}
+
+func (c *noiseConn) Read(b []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		msg, err := readNoiseMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		if c.readBuf, err = c.recv.aead.Open(msg[:0], c.recv.nonce(), msg, nil); err != nil {
+			return 0, errNoiseDecrypt
+		}
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *noiseConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	var out []byte
+	for rest := b; len(rest) > 0; {
+		n := len(rest)
+		if n > noiseMaxMessage-noiseTagLen {
+			n = noiseMaxMessage - noiseTagLen
+		}
+		out = binary.BigEndian.AppendUint16(out, uint16(n+noiseTagLen))
+		out = c.send.aead.Seal(out, c.send.nonce(), rest[:n], nil)
+		rest = rest[n:]
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,256 @@
+package conn
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func mustNoiseKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	k, err := GenerateNoiseKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// TestNoiseIKVector checks the handshake & transport messages against the
+// Noise_IK_25519_AESGCM_SHA256 vector (with payloads, and no prologue) from
+// the test vectors of github.com/flynn/noise.
+func TestNoiseIKVector(t *testing.T) {
+	newKey := func(s string) *ecdh.PrivateKey {
+		k, err := ecdh.X25519().NewPrivateKey(mustHex(t, s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	initStatic := newKey("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	respStatic := newKey("0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20")
+	initEphemeral := newKey("202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f")
+	respEphemeral := newKey("4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60")
+	payloads := []string{"746573745f6d73675f30", "746573745f6d73675f31", "79656c6c6f777375626d6172696e65", "7375626d6172696e6579656c6c6f77"}
+	ciphertexts := []string{
+		"358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd16625419d6fab175300a577115c701c41ed681373f0432f81d3bf8676bd05216cd1919ba2eaa418fdd8e09ae59d7cf57869de4e6d8177aa9777fe9b843100e255aee76034f61b96b52af38660c",
+		"64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d4846658a7bb8caac509783390e5a04df4a3ca570b2bcdf65f8c1c40cd",
+		"80a75e75c8e8d2e9c2a6c7bc6e550c4997d6d2b45429a530821c4aa5d36f27",
+		"b8475410da62a98493d33a1e669f8f56dd8f61d449b53bd375299c3435424a",
+	}
+
+	initiator := newNoiseHandshake(nil, respStatic.PublicKey())
+	responder := newNoiseHandshake(nil, respStatic.PublicKey())
+
+	msg, err := initiator.writeInitiation(initEphemeral, initStatic, respStatic.PublicKey(), mustHex(t, payloads[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, mustHex(t, ciphertexts[0])) {
+		t.Fatalf("initiation = %x, want %s", msg, ciphertexts[0])
+	}
+	re, rs, payload, err := responder.readInitiation(respStatic, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rs.Equal(initStatic.PublicKey()) || !bytes.Equal(payload, mustHex(t, payloads[0])) {
+		t.Fatalf("readInitiation() = %x, %x, want %x, %s", rs.Bytes(), payload, initStatic.PublicKey().Bytes(), payloads[0])
+	}
+
+	if msg, err = responder.writeResponse(respEphemeral, re, rs, mustHex(t, payloads[1])); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, mustHex(t, ciphertexts[1])) {
+		t.Fatalf("response = %x, want %s", msg, ciphertexts[1])
+	}
+	if payload, err = initiator.readResponse(initEphemeral, initStatic, msg); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, mustHex(t, payloads[1])) {
+		t.Fatalf("readResponse() = %x, want %s", payload, payloads[1])
+	}
+
+	initSend, initRecv := initiator.split()
+	respRecv, respSend := responder.split()
+	for i, c := range []struct{ send, recv *noiseCipher }{{initSend, respRecv}, {respSend, initRecv}} {
+		want := mustHex(t, ciphertexts[2+i])
+		if ct := c.send.aead.Seal(nil, c.send.nonce(), mustHex(t, payloads[2+i]), nil); !bytes.Equal(ct, want) {
+			t.Errorf("transport message %d = %x, want %x", i, ct, want)
+		}
+		if pt, err := c.recv.aead.Open(nil, c.recv.nonce(), want, nil); err != nil || !bytes.Equal(pt, mustHex(t, payloads[2+i])) {
+			t.Errorf("transport message %d decrypted to %x, %v", i, pt, err)
+		}
+	}
+}
+
+type noiseTest struct {
+	client, server       *NoiseTransport
+	clientKey, serverKey *ecdh.PrivateKey
+}
+
+func newNoiseTest(t *testing.T) *noiseTest {
+	nt := &noiseTest{clientKey: mustNoiseKey(t), serverKey: mustNoiseKey(t)}
+	nt.client = &NoiseTransport{Key: nt.clientKey, RemoteKey: nt.serverKey.PublicKey()}
+	nt.server = &NoiseTransport{
+		Key: nt.serverKey,
+		Authorize: func(key *ecdh.PublicKey) (string, bool) {
+			return "alice", key.Equal(nt.clientKey.PublicKey())
+		},
+	}
+	return nt
+}
+
+// handshake connects client to server over a pipe, with the client's end
+// wrapped in a tapConn.
+func (nt *noiseTest) handshake(client *NoiseTransport) (*tapConn, net.Conn, net.Conn, error, error) {
+	clientRaw, serverRaw := net.Pipe()
+	tap := &tapConn{Conn: clientRaw}
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		c, err := nt.server.Server(serverRaw)
+		done <- result{c, err}
+	}()
+	c, clientErr := client.Client(tap)
+	s := <-done
+	return tap, c, s.c, clientErr, s.err
+}
+
+func TestNoiseRoundTrip(t *testing.T) {
+	nt := newNoiseTest(t)
+	_, c, s, clientErr, serverErr := nt.handshake(nt.client)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: %v, %v", clientErr, serverErr)
+	}
+	defer c.Close()
+	if name := PeerName(s); name != "alice" {
+		t.Errorf("PeerName() = %q, want alice", name)
+	}
+	if name := PeerName(c); name != "" {
+		t.Errorf("PeerName() of client = %q, want none", name)
+	}
+
+	// Larger than a transport message, so it is split.
+	big := bytes.Repeat([]byte("0123456789"), noiseMaxMessage/5)
+	for _, dir := range []struct {
+		name     string
+		from, to net.Conn
+	}{{"client to server", c, s}, {"server to client", s, c}} {
+		go dir.from.Write(big)
+		got := make([]byte, len(big))
+		if _, err := io.ReadFull(dir.to, got); err != nil {
+			t.Fatalf("%s: %v", dir.name, err)
+		}
+		if !bytes.Equal(got, big) {
+			t.Errorf("%s: received bytes differ", dir.name)
+		}
+	}
+}
+
+func TestNoiseWrongServerKey(t *testing.T) {
+	nt := newNoiseTest(t)
+	client := &NoiseTransport{Key: nt.clientKey, RemoteKey: mustNoiseKey(t).PublicKey()}
+	if _, _, _, clientErr, serverErr := nt.handshake(client); clientErr == nil || serverErr == nil {
+		t.Fatalf("handshake with the wrong server key succeeded: %v, %v", clientErr, serverErr)
+	}
+}
+
+func TestNoiseUnknownClient(t *testing.T) {
+	nt := newNoiseTest(t)
+	client := &NoiseTransport{Key: mustNoiseKey(t), RemoteKey: nt.serverKey.PublicKey()}
+	_, _, _, clientErr, serverErr := nt.handshake(client)
+	if serverErr == nil || !strings.Contains(serverErr.Error(), "unknown client key") {
+		t.Errorf("server error = %v, want unknown client key", serverErr)
+	}
+	if clientErr == nil {
+		t.Error("client handshake succeeded")
+	}
+}
+
+func TestNoiseReplayedHandshake(t *testing.T) {
+	nt := newNoiseTest(t)
+	tap, c, _, clientErr, serverErr := nt.handshake(nt.client)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: %v, %v", clientErr, serverErr)
+	}
+	c.Close()
+
+	attacker, serverRaw := net.Pipe()
+	go func() {
+		attacker.Write(tap.written.Bytes())
+		io.Copy(io.Discard, attacker)
+	}()
+	_, err := nt.server.Server(serverRaw)
+	if err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Errorf("replayed handshake: err = %v, want replayed", err)
+	}
+}
+
+func TestNoiseTimestamps(t *testing.T) {
+	var nt NoiseTransport
+	for _, c := range []struct {
+		key  string
+		ts   uint64
+		want bool
+	}{
+		{"a", 10, true},
+		{"a", 10, false}, // the same
+		{"a", 9, false},  // older
+		{"a", 11, true},
+		{"b", 5, true}, // another client
+	} {
+		if got := nt.checkTimestamp([]byte(c.key), c.ts); got != c.want {
+			t.Errorf("checkTimestamp(%s, %d) = %v, want %v", c.key, c.ts, got, c.want)
+		}
+	}
+}
+
+func TestNoiseTamperedMessage(t *testing.T) {
+	nt := newNoiseTest(t)
+	tap, c, s, clientErr, serverErr := nt.handshake(nt.client)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: %v, %v", clientErr, serverErr)
+	}
+	defer c.Close()
+
+	tap.flip = true
+	go c.Write([]byte("hello"))
+	if _, err := s.Read(make([]byte, 16)); err != errNoiseDecrypt {
+		t.Errorf("Read() of a tampered message: err = %v, want %v", err, errNoiseDecrypt)
+	}
+}
+
+func TestNoiseReplayedMessage(t *testing.T) {
+	nt := newNoiseTest(t)
+	tap, c, s, clientErr, serverErr := nt.handshake(nt.client)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: %v, %v", clientErr, serverErr)
+	}
+	defer c.Close()
+
+	tap.repeat = true
+	go c.Write([]byte("hello"))
+	buf := make([]byte, 16)
+	if n, err := s.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+	// The copy was sealed with a nonce which has been used.
+	if _, err := s.Read(buf); err != errNoiseDecrypt {
+		t.Errorf("Read() of a repeated message: err = %v, want %v", err, errNoiseDecrypt)
+	}
+}
@@ -0,0 +1,398 @@
+package conn
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	obfsMinKeyLen = 16
+	obfsSeedLen   = 32
+
+	// Bytes are carried in frames of between obfsMinChunk & obfsMaxChunk
+	// bytes (or fewer, if fewer are queued), followed by up to
+	// obfsMaxPadding random bytes.
+	obfsMinChunk   = 256
+	obfsMaxChunk   = 16 * 1024
+	obfsMaxPadding = 512
+
+	// obfsMaxDelay is the longest queued bytes are held before being sent.
+	obfsMaxDelay = 2 * time.Millisecond
+	// obfsMaxPending is how many bytes can be queued before Write blocks.
+	obfsMaxPending = 64 * 1024
+
+	// obfsHandshakeTimeout bounds the client's handshake, as a server with
+	// a different key never responds.
+	obfsHandshakeTimeout = 15 * time.Second
+	// obfsMaxSkew is how far the time in a client's first frame may be from
+	// the server's clock.
+	obfsMaxSkew = 2 * time.Minute
+	obfsTimeLen = 8
+)
+
+var (
+	errObfsFrame   = errors.New("invalid obfuscated frame (wrong key?)")
+	errObfsReplay  = errors.New("replayed or stale obfuscated handshake (clock skew?)")
+	errObfsTimeout = errors.New("no response from server (wrong obfuscation key, or clock?)")
+)
+
+// LoadObfsKey reads a pre-shared obfuscation key from a file. Surrounding
+// whitespace is ignored.
+func LoadObfsKey(path string) ([]byte, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(d)
+	if len(key) < obfsMinKeyLen {
+		return nil, errors.New("obfuscation key is too short")
+	}
+	return key, nil
+}
+
+// ObfsTransport disguises the stream of Inner as random bytes, so it cannot
+// be identified by the TLS handshake, or by the size & timing of its
+// records. Each side sends a random seed, from which keys are derived with
+// the pre-shared Key. Bytes are then carried in encrypted frames of random
+// size & padding, which are sent after a random delay.
+//
+// The server does not respond until a frame from the client has been
+// authenticated, so it cannot be discovered by probing without the key. The
+// client's first frame carries the time, and the server refuses seeds it has
+// already seen, so a recorded opening cannot be replayed to probe it either.
+type ObfsTransport struct {
+	Key   []byte
+	Inner Transport
+	// Replays records the seeds of clients. It is required by Server, and
+	// must be shared by all of a server's connections.
+	Replays *ObfsReplayCache
+}
+
+// ObfsReplayCache records the seeds of recent client openings, so they are
+// only accepted once. The zero value is ready to use.
+type ObfsReplayCache struct {
+	lock sync.Mutex
+	seen map[string]time.Time // seed -> when it may be forgotten
+}
+
+// add records seed, returning false if it is already recorded.
+func (r *ObfsReplayCache) add(seed []byte) bool {
+	now := time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.seen == nil {
+		r.seen = map[string]time.Time{}
+	}
+	for s, expiry := range r.seen {
+		if now.After(expiry) {
+			delete(r.seen, s)
+		}
+	}
+	if _, ok := r.seen[string(seed)]; ok {
+		return false
+	}
+	// Openings are refused once their time is obfsMaxSkew old, and it may
+	// be up to obfsMaxSkew ahead of now.
+	r.seen[string(seed)] = now.Add(2 * obfsMaxSkew)
+	return true
+}
+
+// Client implements Transport.
+func (t *ObfsTransport) Client(rawConn net.Conn) (net.Conn, error) {
+	c, err := newObfsConn(rawConn, t.Key, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	rawConn.SetDeadline(time.Now().Add(obfsHandshakeTimeout))
+	out, err := t.Inner.Client(c)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil, errObfsTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	rawConn.SetDeadline(time.Time{})
+	return out, nil
+}
+
+// Server implements Transport.
+func (t *ObfsTransport) Server(rawConn net.Conn) (net.Conn, error) {
+	if t.Replays == nil {
+		return nil, errors.New("obfuscated server requires a replay cache")
+	}
+	c, err := newObfsConn(rawConn, t.Key, false, t.Replays)
+	if err != nil {
+		return nil, err
+	}
+	return t.Inner.Server(c)
+}
+
+// obfsCipher encrypts or decrypts the frames sent in one direction.
+type obfsCipher struct {
+	aead  cipher.AEAD
+	mask  cipher.Stream // hides frame lengths
+	count uint64
+}
+
+func newObfsCipher(key, seed []byte, fromClient bool) (*obfsCipher, error) {
+	dir := " server"
+	if fromClient {
+		dir = " client"
+	}
+	derive := func(label string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte("subnet-obfs " + label + dir))
+		h.Write(seed)
+		return h.Sum(nil)
+	}
+
+	block, err := aes.NewCipher(derive("data"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	maskKey := derive("mask")
+	maskBlock, err := aes.NewCipher(maskKey[:16])
+	if err != nil {
+		return nil, err
+	}
+	return &obfsCipher{aead: aead, mask: cipher.NewCTR(maskBlock, maskKey[16:])}, nil
+}
+
+func (o *obfsCipher) nonce() []byte {
+	n := make([]byte, o.aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], o.count)
+	o.count++
+	return n
+}
+
+// obfsConn carries a stream in obfuscated frames. Writes are queued, and
+// framed by writeLoop.
+type obfsConn struct {
+	net.Conn
+	key      []byte
+	isClient bool
+	replays  *ObfsReplayCache // on the server
+
+	reader     *obfsCipher // set once the peer's seed is read
+	readerSeed []byte
+	readBuf    []byte
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	writer   *obfsCipher
+	seed     []byte // sent ahead of the first frame
+	pending  []byte
+	writeErr error
+	closed   bool
+	done     chan struct{}
+}
+
+func newObfsConn(rawConn net.Conn, key []byte, isClient bool, replays *ObfsReplayCache) (*obfsConn, error) {
+	seed := make([]byte, obfsSeedLen)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	writer, err := newObfsCipher(key, seed, isClient)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &obfsConn{
+		Conn:     rawConn,
+		key:      key,
+		isClient: isClient,
+		replays:  replays,
+		writer:   writer,
+		seed:     seed,
+		done:     make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.lock)
+	go c.writeLoop()
+	return c, nil
+}
+
+func (c *obfsConn) Read(b []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *obfsConn) readFrame() error {
+	if c.reader == nil {
+		seed := make([]byte, obfsSeedLen)
+		if _, err := io.ReadFull(c.Conn, seed); err != nil {
+			return err
+		}
+		reader, err := newObfsCipher(c.key, seed, !c.isClient)
+		if err != nil {
+			return err
+		}
+		c.reader, c.readerSeed = reader, seed
+	}
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+		return err
+	}
+	c.reader.mask.XORKeyStream(hdr[:], hdr[:])
+	frame := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(c.Conn, frame); err != nil {
+		return err
+	}
+
+	plain, err := c.reader.aead.Open(frame[:0], c.reader.nonce(), frame, nil)
+	if err != nil {
+		err = errObfsFrame
+	} else if !c.isClient && c.reader.count == 1 {
+		plain, err = c.checkOpening(plain)
+	}
+	if err == nil && (len(plain) < 2 || int(binary.BigEndian.Uint16(plain)) > len(plain)-2) {
+		err = errObfsFrame
+	}
+	if err != nil {
+		// Never respond to a peer without the key, or replaying a client.
+		c.lock.Lock()
+		c.writeErr = err
+		c.cond.Broadcast()
+		c.lock.Unlock()
+		return err
+	}
+	c.readBuf = plain[2 : 2+binary.BigEndian.Uint16(plain)]
+	return nil
+}
+
+// checkOpening returns the rest of the client's first frame, or an error
+// unless the time heading it is close to now, and its seed has not been seen
+// before.
+func (c *obfsConn) checkOpening(plain []byte) ([]byte, error) {
+	if len(plain) < obfsTimeLen {
+		return nil, errObfsFrame
+	}
+	sent := time.Unix(int64(binary.BigEndian.Uint64(plain)), 0)
+	if d := time.Since(sent); d > obfsMaxSkew || d < -obfsMaxSkew {
+		return nil, errObfsReplay
+	}
+	if !c.replays.add(c.readerSeed) {
+		return nil, errObfsReplay
+	}
+	return plain[obfsTimeLen:], nil
+}
+
+// Write queues b to be sent by writeLoop, blocking while too many bytes
+// are queued.
+func (c *obfsConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.pending) >= obfsMaxPending && c.writeErr == nil && !c.closed {
+		c.cond.Wait()
+	}
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	c.pending = append(c.pending, b...)
+	c.cond.Broadcast()
+	return len(b), nil
+}
+
+// writeLoop sends queued bytes after a random delay, until the connection
+// is closed & all queued bytes are sent.
+func (c *obfsConn) writeLoop() {
+	defer close(c.done)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for {
+		for len(c.pending) == 0 && c.writeErr == nil && !c.closed {
+			c.cond.Wait()
+		}
+		if len(c.pending) == 0 || c.writeErr != nil {
+			return
+		}
+		if !c.closed {
+			c.lock.Unlock()
+			time.Sleep(time.Duration(mrand.Int63n(int64(obfsMaxDelay))))
+			c.lock.Lock()
+		}
+		data := c.pending
+		c.pending = nil
+		c.cond.Broadcast()
+
+		c.lock.Unlock()
+		err := c.send(data)
+		c.lock.Lock()
+		if err != nil && c.writeErr == nil {
+			c.writeErr = err
+			c.cond.Broadcast()
+		}
+	}
+}
+
+// send writes data as frames of random size & padding. Only called by
+// writeLoop.
+func (c *obfsConn) send(data []byte) error {
+	out := c.seed
+	c.seed = nil
+	for len(data) > 0 {
+		n := obfsMinChunk + mrand.Intn(obfsMaxChunk-obfsMinChunk+1)
+		if n > len(data) {
+			n = len(data)
+		}
+		plain := make([]byte, 2+n+mrand.Intn(obfsMaxPadding+1))
+		binary.BigEndian.PutUint16(plain, uint16(n))
+		copy(plain[2:], data[:n])
+		if _, err := rand.Read(plain[2+n:]); err != nil {
+			return err
+		}
+		data = data[n:]
+		if c.isClient && c.writer.count == 0 {
+			// The first frame from the client leads with the time.
+			var now [obfsTimeLen]byte
+			binary.BigEndian.PutUint64(now[:], uint64(time.Now().Unix()))
+			plain = append(now[:], plain...)
+		}
+
+		sealed := c.writer.aead.Seal(nil, c.writer.nonce(), plain, nil)
+		var hdr [2]byte
+		binary.BigEndian.PutUint16(hdr[:], uint16(len(sealed)))
+		c.writer.mask.XORKeyStream(hdr[:], hdr[:])
+		out = append(append(out, hdr[:]...), sealed...)
+	}
+	_, err := c.Conn.Write(out)
+	return err
+}
+
+// Close sends any queued bytes, waiting up to a second, then closes the
+// connection.
+func (c *obfsConn) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.lock.Unlock()
+
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	<-c.done
+	return c.Conn.Close()
+}
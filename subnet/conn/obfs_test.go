@@ -0,0 +1,213 @@
+package conn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// plainTransport passes connections through unchanged.
+type plainTransport struct{}
+
+func (plainTransport) Client(c net.Conn) (net.Conn, error) { return c, nil }
+func (plainTransport) Server(c net.Conn) (net.Conn, error) { return c, nil }
+
+// tapConn records the bytes written to it, and can tamper with them.
+type tapConn struct {
+	net.Conn
+	written bytes.Buffer
+	flip    bool // flip the last bit of each write
+	repeat  bool // send each write twice
+}
+
+func (c *tapConn) Write(b []byte) (int, error) {
+	c.written.Write(b)
+	out := append([]byte(nil), b...)
+	if c.flip {
+		out[len(out)-1] ^= 1
+	}
+	if c.repeat {
+		out = append(out, out...)
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+var testObfsKey = []byte("0123456789abcdef0123456789abcdef")
+
+// obfsPair connects an obfuscated client to server over a pipe, with the
+// client's end wrapped in a tapConn.
+func obfsPair(t *testing.T, clientKey []byte, server *ObfsTransport) (*tapConn, net.Conn, net.Conn) {
+	t.Helper()
+	clientRaw, serverRaw := net.Pipe()
+	tap := &tapConn{Conn: clientRaw}
+	c, err := (&ObfsTransport{Key: clientKey, Inner: plainTransport{}}).Client(tap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.Server(serverRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tap, c, s
+}
+
+func newObfsServer() *ObfsTransport {
+	return &ObfsTransport{Key: testObfsKey, Inner: plainTransport{}, Replays: &ObfsReplayCache{}}
+}
+
+func TestObfsRoundTrip(t *testing.T) {
+	_, c, s := obfsPair(t, testObfsKey, newObfsServer())
+	defer c.Close()
+	defer s.Close()
+
+	// Several frames' worth, so the stream is split & reassembled.
+	data := make([]byte, 5*obfsMaxChunk+123)
+	rand.Read(data)
+	for _, dir := range []struct {
+		name     string
+		from, to net.Conn
+	}{{"client to server", c, s}, {"server to client", s, c}} {
+		go func(from net.Conn) {
+			for rest := data; len(rest) > 0; {
+				n := 1 + len(rest)%4000
+				if n > len(rest) {
+					n = len(rest)
+				}
+				from.Write(rest[:n])
+				rest = rest[n:]
+			}
+		}(dir.from)
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(dir.to, got); err != nil {
+			t.Fatalf("%s: %v", dir.name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: received bytes differ", dir.name)
+		}
+	}
+}
+
+func TestObfsServerRequiresReplayCache(t *testing.T) {
+	_, serverRaw := net.Pipe()
+	if _, err := (&ObfsTransport{Key: testObfsKey, Inner: plainTransport{}}).Server(serverRaw); err == nil {
+		t.Error("Server() without a replay cache succeeded")
+	}
+}
+
+// serverRejects writes data from c and returns the error reading it at s,
+// after checking that s will not send anything in response.
+func serverRejects(t *testing.T, c, s net.Conn, data []byte) error {
+	t.Helper()
+	go c.Write(data)
+	_, err := s.Read(make([]byte, 16))
+	if err == nil {
+		t.Fatal("server read rejected bytes")
+	}
+	if _, werr := s.Write([]byte("response")); werr == nil {
+		t.Error("server responded after rejecting a frame")
+	}
+	return err
+}
+
+func TestObfsWrongKey(t *testing.T) {
+	_, c, s := obfsPair(t, []byte("another key, long enough"), newObfsServer())
+	defer c.Close()
+	// More than the longest frame, as the length read by a server with
+	// another key is random.
+	if err := serverRejects(t, c, s, make([]byte, 0x10000)); err != errObfsFrame {
+		t.Errorf("err = %v, want %v", err, errObfsFrame)
+	}
+}
+
+func TestObfsTamperedFrame(t *testing.T) {
+	tap, c, s := obfsPair(t, testObfsKey, newObfsServer())
+	defer c.Close()
+	tap.flip = true // in the tag of the only frame
+	if err := serverRejects(t, c, s, []byte("hello")); err != errObfsFrame {
+		t.Errorf("err = %v, want %v", err, errObfsFrame)
+	}
+}
+
+func TestObfsReplayedOpening(t *testing.T) {
+	server := newObfsServer()
+	tap, c, s := obfsPair(t, testObfsKey, server)
+	go c.Write([]byte("hello"))
+	if _, err := s.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	opening := tap.written.Bytes()
+
+	replay := func(server *ObfsTransport) error {
+		attacker, serverRaw := net.Pipe()
+		defer attacker.Close()
+		go attacker.Write(opening)
+		s, err := server.Server(serverRaw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Read(make([]byte, 16))
+		return err
+	}
+	if err := replay(server); err != errObfsReplay {
+		t.Errorf("replayed opening: err = %v, want %v", err, errObfsReplay)
+	}
+	// Only the replay cache stops it.
+	if err := replay(newObfsServer()); err != nil {
+		t.Errorf("opening to a server which has not seen it: err = %v", err)
+	}
+}
+
+func TestObfsOpeningTime(t *testing.T) {
+	for _, c := range []struct {
+		offset time.Duration
+		want   error
+	}{
+		{0, nil},
+		{-obfsMaxSkew + time.Minute, nil},
+		{obfsMaxSkew - time.Minute, nil},
+		{-obfsMaxSkew - time.Minute, errObfsReplay},
+		{obfsMaxSkew + time.Minute, errObfsReplay},
+	} {
+		conn := &obfsConn{replays: &ObfsReplayCache{}, readerSeed: []byte("seed")}
+		plain := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Add(c.offset).Unix()))
+		plain = append(plain, "rest"...)
+		rest, err := conn.checkOpening(plain)
+		if err != c.want {
+			t.Errorf("opening sent %s from now: err = %v, want %v", c.offset, err, c.want)
+		}
+		if err == nil && string(rest) != "rest" {
+			t.Errorf("checkOpening() = %q, want the rest of the frame", rest)
+		}
+	}
+
+	conn := &obfsConn{replays: &ObfsReplayCache{}, readerSeed: []byte("seed")}
+	if _, err := conn.checkOpening([]byte{1, 2, 3}); err != errObfsFrame {
+		t.Errorf("short opening: err = %v, want %v", err, errObfsFrame)
+	}
+}
+
+func TestObfsReplayCache(t *testing.T) {
+	var r ObfsReplayCache
+	if !r.add([]byte("a")) || !r.add([]byte("b")) {
+		t.Fatal("add() of new seeds = false")
+	}
+	if r.add([]byte("a")) {
+		t.Error("add() of a seen seed = true")
+	}
+
+	r.seen["a"] = time.Now().Add(-time.Second)
+	if !r.add([]byte("a")) {
+		t.Error("add() of an expired seed = false")
+	}
+	if _, ok := r.seen["b"]; !ok {
+		t.Error("unexpired seed was forgotten")
+	}
+}
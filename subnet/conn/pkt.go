@@ -8,4 +8,10 @@ const (
 	PktUnknown PktType = iota
 	PktIPPkt
 	PktLocalAddr
+	PktDNSConfig
+	PktEthFrame
+	PktRouteAdvert
+	PktRouteWithdraw
+	PktSession
+	PktResume
 )
@@ -3,10 +3,16 @@ package conn
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/twitchyliquid64/subnet/subnet/cert"
@@ -17,22 +23,20 @@ import (
 // If caCertPath is empty, no trust root is established and no client/serv verification
 // is performed.
 func TLSConfig(certPemPath, keyPemPath, caCertPath string) (*tls.Config, error) {
-	var caCertParsed *x509.Certificate
+	var cas []*x509.Certificate
 	if caCertPath != "" {
-		pemBytes, err := ioutil.ReadFile(caCertPath)
-		if err != nil {
-			return nil, err
-		}
-		certDERBlock, _ := pem.Decode(pemBytes)
-		if certDERBlock == nil {
-			return nil, errors.New("No certificate data read from PEM")
-		}
-		caCertParsed, err = x509.ParseCertificate(certDERBlock.Bytes)
+		caCertParsed, err := LoadCACert(caCertPath)
 		if err != nil {
 			return nil, err
 		}
+		cas = append(cas, caCertParsed)
 	}
+	return TLSConfigMultiCA(certPemPath, keyPemPath, cas)
+}
 
+// TLSConfigMultiCA is like TLSConfig, but accepts a peer certificate signed by
+// any of the given CAs.
+func TLSConfigMultiCA(certPemPath, keyPemPath string, cas []*x509.Certificate) (*tls.Config, error) {
 	gTLSConfig := &tls.Config{
 		MinVersion:               tls.VersionTLS12,
 		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
@@ -44,7 +48,7 @@ func TLSConfig(certPemPath, keyPemPath, caCertPath string) (*tls.Config, error)
 			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
 		},
 		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-			if caCertParsed == nil {
+			if len(cas) == 0 {
 				return nil //perform no verification
 			}
 			for _, c := range rawCerts {
@@ -52,13 +56,10 @@ func TLSConfig(certPemPath, keyPemPath, caCertPath string) (*tls.Config, error)
 				if err != nil {
 					return err
 				}
-				certErr := parsedCert.CheckSignatureFrom(caCertParsed)
-				if parsedCert.NotAfter.Before(time.Now()) || parsedCert.NotBefore.After(time.Now()) {
-					certErr = errors.New("Certificate expired or used too soon")
-				}
-				if certErr == nil {
-					if crlErr := cert.CheckCRL(parsedCert); crlErr != nil {
-						certErr = crlErr
+				var certErr error
+				for _, ca := range cas {
+					if certErr = VerifyCert(parsedCert, ca); certErr == nil {
+						break
 					}
 				}
 				log.Printf("Remote presented certificate %d with time bounds (%v-%v). Verification error for certificate: %+v", parsedCert.SerialNumber, parsedCert.NotBefore, parsedCert.NotAfter, certErr)
@@ -66,7 +67,25 @@ func TLSConfig(certPemPath, keyPemPath, caCertPath string) (*tls.Config, error)
 			}
 			return errors.New("Expected certificate which would pass, none presented")
 		},
+		// VerifyPeerCertificate is not called when a session is resumed, so
+		// check the certificate from the original handshake is still valid.
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if !state.DidResume || len(cas) == 0 {
+				return nil
+			}
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("Resumed session has no peer certificate")
+			}
+			var certErr error
+			for _, ca := range cas {
+				if certErr = VerifyCert(state.PeerCertificates[0], ca); certErr == nil {
+					break
+				}
+			}
+			return certErr
+		},
 		InsecureSkipVerify: true,
+		NextProtos:         []string{ALPNProtocol},
 	}
 
 	if certPemPath != "" {
@@ -77,7 +96,7 @@ func TLSConfig(certPemPath, keyPemPath, caCertPath string) (*tls.Config, error)
 		gTLSConfig.Certificates = []tls.Certificate{mainCert}
 	}
 
-	if caCertPath == "" {
+	if len(cas) == 0 {
 		log.Println("Warning: No CA certificate specified. Skipping TLS verification of server. This is bad!")
 	} else {
 		gTLSConfig.ClientAuth = tls.RequestClientCert
@@ -85,3 +104,160 @@ func TLSConfig(certPemPath, keyPemPath, caCertPath string) (*tls.Config, error)
 
 	return gTLSConfig, nil
 }
+
+// LoadCACert reads a PEM-encoded CA certificate.
+func LoadCACert(caCertPath string) (*x509.Certificate, error) {
+	pemBytes, err := ioutil.ReadFile(caCertPath)
+	if err != nil {
+		return nil, err
+	}
+	certDERBlock, _ := pem.Decode(pemBytes)
+	if certDERBlock == nil {
+		return nil, errors.New("No certificate data read from PEM")
+	}
+	return x509.ParseCertificate(certDERBlock.Bytes)
+}
+
+// VerifyCert returns nil if c was signed by ca, is within its validity period,
+// and has not been revoked.
+func VerifyCert(c, ca *x509.Certificate) error {
+	if err := c.CheckSignatureFrom(ca); err != nil {
+		return err
+	}
+	if c.NotAfter.Before(time.Now()) || c.NotBefore.After(time.Now()) {
+		return errors.New("Certificate expired or used too soon")
+	}
+	return cert.CheckCRL(c)
+}
+
+// VerifyHostCertificate returns nil if certs is a chain valid for host under
+// the system's trusted roots, as presented by an ordinary web server.
+func VerifyHostCertificate(certs []*x509.Certificate, host string) error {
+	if len(certs) == 0 {
+		return errors.New("Expected certificate which would pass, none presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates})
+	return err
+}
+
+// Handshake performs a TLS handshake over rawConn, acting as the client if isClient
+// is set. If offload is set, the session keys are handed to the kernel (kTLS) once
+// the handshake completes, and the returned connection reads & writes plaintext
+// through the socket. If the kernel or the negotiated session cannot be offloaded,
+// the returned connection falls back to crypto/tls.
+func Handshake(rawConn net.Conn, config *tls.Config, isClient, offload bool) (net.Conn, error) {
+	var keys *keyLog
+	if offload {
+		config = config.Clone()
+		keys = &keyLog{}
+		config.KeyLogWriter = keys
+		// Session tickets are post-handshake messages the kernel would not understand.
+		config.SessionTicketsDisabled = true
+		// Make sure crypto/tls never buffers bytes past the end of the handshake.
+		rawConn = &recordReader{Conn: rawConn}
+	}
+
+	var tlsConn *tls.Conn
+	if isClient {
+		tlsConn = tls.Client(rawConn, config)
+	} else {
+		tlsConn = tls.Server(rawConn, config)
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	if !offload {
+		return tlsConn, nil
+	}
+
+	socket := rawConn.(*recordReader).Conn
+	if p, ok := socket.(*prefixConn); ok {
+		socket = p.Conn // the replayed ClientHello was consumed by the handshake
+	}
+	c, err := offloadTLS(tlsConn, socket, keys, isClient)
+	if err != nil {
+		log.Printf("Kernel TLS unavailable, using crypto/tls: %s\n", err)
+		return tlsConn, nil
+	}
+	return c, nil
+}
+
+// PeerCertificate returns the certificate presented by the remote end of c,
+// or nil if none was presented.
+func PeerCertificate(c net.Conn) *x509.Certificate {
+	s, ok := c.(interface {
+		ConnectionState() tls.ConnectionState
+	})
+	if !ok {
+		return nil
+	}
+	if certs := s.ConnectionState().PeerCertificates; len(certs) > 0 {
+		return certs[0]
+	}
+	return nil
+}
+
+// keyLog captures the secrets written by crypto/tls in NSS key log format.
+type keyLog struct {
+	mu      sync.Mutex
+	secrets map[string][]byte
+}
+
+func (k *keyLog) Write(line []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 {
+		return len(line), nil
+	}
+	secret, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return 0, err
+	}
+	if k.secrets == nil {
+		k.secrets = map[string][]byte{}
+	}
+	k.secrets[fields[0]] = secret
+	return len(line), nil
+}
+
+func (k *keyLog) secret(label string) []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.secrets[label]
+}
+
+// recordReader never returns bytes past the end of the current TLS record, so
+// nothing after the handshake is consumed from the socket by crypto/tls.
+type recordReader struct {
+	net.Conn
+	hdr       [5]byte
+	hdrLen    int
+	remaining int
+}
+
+func (r *recordReader) Read(b []byte) (int, error) {
+	if r.remaining == 0 && r.hdrLen == 0 {
+		if _, err := io.ReadFull(r.Conn, r.hdr[:]); err != nil {
+			return 0, err
+		}
+		r.hdrLen = len(r.hdr)
+		r.remaining = int(binary.BigEndian.Uint16(r.hdr[3:5]))
+	}
+	if r.hdrLen > 0 {
+		n := copy(b, r.hdr[len(r.hdr)-r.hdrLen:])
+		r.hdrLen -= n
+		return n, nil
+	}
+	if len(b) > r.remaining {
+		b = b[:r.remaining]
+	}
+	n, err := r.Conn.Read(b)
+	r.remaining -= n
+	return n, err
+}
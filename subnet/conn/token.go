@@ -0,0 +1,105 @@
+package conn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignToken returns a token proving possession of the key of cert, for use
+// where a client certificate cannot be presented in the TLS handshake (for
+// instance behind a reverse proxy). The token is bound to path, and carries
+// the certificate, the time, a nonce, and a signature over all three.
+func SignToken(cert tls.Certificate, path string) (string, error) {
+	return signToken(cert, path, time.Now())
+}
+
+func signToken(cert tls.Certificate, path string, now time.Time) (string, error) {
+	if len(cert.Certificate) == 0 {
+		return "", errors.New("no certificate to sign a token with")
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return "", errors.New("key cannot sign tokens")
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	ts := strconv.FormatInt(now.Unix(), 10)
+	msg := tokenMessage(path, ts, enc.EncodeToString(nonce))
+	var sig []byte
+	var err error
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		sig, err = signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(msg)
+		sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return enc.EncodeToString(cert.Certificate[0]) + "." + ts + "." + enc.EncodeToString(nonce) + "." + enc.EncodeToString(sig), nil
+}
+
+// VerifyToken checks that token was signed for path within maxAge, returning
+// the certificate it carries. The certificate itself is not verified.
+func VerifyToken(token, path string, maxAge time.Duration) (*x509.Certificate, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return nil, errors.New("malformed token")
+	}
+	enc := base64.RawURLEncoding
+	der, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token certificate")
+	}
+	sig, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("malformed token time")
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > maxAge || age < -maxAge {
+		return nil, errors.New("token expired")
+	}
+
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	var algo x509.SignatureAlgorithm
+	switch c.PublicKey.(type) {
+	case *rsa.PublicKey:
+		algo = x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		algo = x509.ECDSAWithSHA256
+	case ed25519.PublicKey:
+		algo = x509.PureEd25519
+	default:
+		return nil, errors.New("unsupported token key type")
+	}
+	if err := c.CheckSignature(algo, tokenMessage(path, parts[1], parts[2]), sig); err != nil {
+		return nil, errors.New("invalid token signature")
+	}
+	return c, nil
+}
+
+func tokenMessage(path, ts, nonce string) []byte {
+	return []byte("subnet-token\n" + path + "\n" + ts + "\n" + nonce)
+}
@@ -0,0 +1,136 @@
+package conn
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/twitchyliquid64/subnet/subnet/conn/conntest"
+)
+
+func testCerts(t *testing.T) map[string]tls.Certificate {
+	t.Helper()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]tls.Certificate{
+		"ecdsa":   conntest.SelfSignedCert(t, ecKey),
+		"ed25519": conntest.SelfSignedCert(t, edKey),
+		"rsa":     conntest.SelfSignedCert(t, rsaKey),
+	}
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	for name, cert := range testCerts(t) {
+		token, err := SignToken(cert, "/subnet")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		c, err := VerifyToken(token, "/subnet", time.Minute)
+		if err != nil {
+			t.Errorf("%s: VerifyToken() err = %v", name, err)
+			continue
+		}
+		if string(c.Raw) != string(cert.Certificate[0]) {
+			t.Errorf("%s: VerifyToken() returned another certificate", name)
+		}
+	}
+}
+
+func TestTokenTampered(t *testing.T) {
+	certs := testCerts(t)
+	token, err := SignToken(certs["ecdsa"], "/subnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := SignToken(certs["ed25519"], "/subnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, otherParts := strings.Split(token, "."), strings.Split(other, ".")
+	with := func(i int, v string) string {
+		p := append([]string(nil), parts...)
+		p[i] = v
+		return strings.Join(p, ".")
+	}
+	flip := func(s string) string {
+		b := []byte(s)
+		if b[len(b)/2] == 'A' {
+			b[len(b)/2] = 'B'
+		} else {
+			b[len(b)/2] = 'A'
+		}
+		return string(b)
+	}
+
+	for _, c := range []struct {
+		name, token, path string
+	}{
+		{"other path", token, "/other"},
+		{"other certificate", with(0, otherParts[0]), "/subnet"},
+		{"other time", with(1, otherParts[1]+"1"), "/subnet"},
+		{"other nonce", with(2, otherParts[2]), "/subnet"},
+		{"other signature", with(3, otherParts[3]), "/subnet"},
+		{"flipped signature", with(3, flip(parts[3])), "/subnet"},
+		{"flipped certificate", with(0, flip(parts[0])), "/subnet"},
+		{"missing part", strings.Join(parts[:3], "."), "/subnet"},
+		{"extra part", token + ".x", "/subnet"},
+		{"empty", "", "/subnet"},
+	} {
+		if _, err := VerifyToken(c.token, c.path, time.Minute); err == nil {
+			t.Errorf("%s: VerifyToken() succeeded", c.name)
+		}
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	cert := testCerts(t)["ecdsa"]
+	for _, c := range []struct {
+		offset time.Duration
+		ok     bool
+	}{
+		{-30 * time.Second, true},
+		{30 * time.Second, true},
+		{-2 * time.Minute, false},
+		{2 * time.Minute, false},
+	} {
+		token, err := signToken(cert, "/subnet", time.Now().Add(c.offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifyToken(token, "/subnet", time.Minute); (err == nil) != c.ok {
+			t.Errorf("token signed %s from now: err = %v, want ok = %v", c.offset, err, c.ok)
+		}
+	}
+}
+
+func TestTokenUnique(t *testing.T) {
+	cert := testCerts(t)["ed25519"]
+	a, err := SignToken(cert, "/subnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := SignToken(cert, "/subnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tokens must differ for a server to refuse replays of one.
+	if a == b {
+		t.Error("two tokens signed in the same second are identical")
+	}
+}
@@ -0,0 +1,33 @@
+package conn
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// Transport establishes the stream over which a client & server exchange
+// messages, on a connection which one side has dialed and the other accepted.
+type Transport interface {
+	// Client performs the client's side of the handshake over rawConn,
+	// returning a connection which carries the stream.
+	Client(rawConn net.Conn) (net.Conn, error)
+	// Server performs the server's side of the handshake over rawConn.
+	Server(rawConn net.Conn) (net.Conn, error)
+}
+
+// TLSTransport is the default transport: a TLS connection using Config,
+// optionally offloaded to the kernel (see Handshake).
+type TLSTransport struct {
+	Config    *tls.Config
+	KernelTLS bool
+}
+
+// Client implements Transport.
+func (t *TLSTransport) Client(rawConn net.Conn) (net.Conn, error) {
+	return Handshake(rawConn, t.Config, true, t.KernelTLS)
+}
+
+// Server implements Transport.
+func (t *TLSTransport) Server(rawConn net.Conn) (net.Conn, error) {
+	return Handshake(rawConn, t.Config, false, t.KernelTLS)
+}
@@ -0,0 +1,274 @@
+package conn
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes (RFC 6455).
+const (
+	wsOpContinuation = 0x0
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsGUID            = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxControlFrame = 125
+)
+
+// DialWebSocket upgrades c, an established (TLS) connection to host, to a
+// WebSocket at path. The returned connection carries a stream of bytes in
+// binary messages.
+func DialWebSocket(c net.Conn, host, path string, header http.Header) (net.Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, errors.New("WebSocket upgrade failed: " + resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, errors.New("WebSocket upgrade failed: invalid Sec-WebSocket-Accept")
+	}
+	return &wsConn{Conn: c, br: br, isClient: true}, nil
+}
+
+// AcceptWebSocket completes the upgrade of an HTTP request to a WebSocket,
+// taking over its connection. An error response is written if the request
+// is not a valid upgrade.
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket upgrade")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection cannot be upgraded", http.StatusInternalServerError)
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &wsConn{Conn: c, br: rw.Reader}, nil
+}
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn reads & writes the payload of binary WebSocket messages. Each write
+// is sent as a single message; message boundaries are not preserved on read.
+type wsConn struct {
+	net.Conn
+	br       *bufio.Reader
+	isClient bool // client frames must be masked
+
+	// state of the data frame being read
+	remaining uint64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+
+	writeLock sync.Mutex
+	closed    bool
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers, handling control frames, until the start of
+// a data frame.
+func (c *wsConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	opcode := hdr[0] & 0xf
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	c.masked = hdr[1]&0x80 != 0
+	c.maskPos = 0
+	if c.masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsOpBinary, wsOpContinuation:
+		c.remaining = length
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > wsMaxControlFrame {
+			return errors.New("WebSocket control frame too long")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		if opcode == wsOpPing {
+			return c.writeFrame(wsOpPong, payload)
+		}
+		if opcode == wsOpClose {
+			c.writeFrame(wsOpClose, nil)
+			return io.EOF
+		}
+		return nil
+	default:
+		return errors.New("unexpected WebSocket frame")
+	}
+}
+
+func (c *wsConn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos%4]
+		c.maskPos++
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.sendFrame(opcode, payload)
+}
+
+// sendFrame writes a frame. Must be called with writeLock held.
+func (c *wsConn) sendFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 2, 14+len(payload))
+	frame[0] = 0x80 | opcode // FIN
+	switch l := len(payload); {
+	case l < 126:
+		frame[1] = byte(l)
+	case l <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(l))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(l))
+	}
+
+	if !c.isClient {
+		frame = append(frame, payload...)
+	} else {
+		frame[1] |= 0x80
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for i, v := range payload {
+			frame = append(frame, v^mask[i%4])
+		}
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame, unless a write is blocked, then closes the
+// connection.
+func (c *wsConn) Close() error {
+	if c.writeLock.TryLock() {
+		if !c.closed {
+			c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+			c.sendFrame(wsOpClose, nil)
+			c.closed = true
+		}
+		c.writeLock.Unlock()
+	}
+	return c.Conn.Close()
+}
@@ -1,5 +1,14 @@
 package subnet
 
+import "net"
+
+// fullTunnelRoutes together cover the IPv4 address space, and are routed
+// through the VPN to redirect all traffic without replacing the default route.
+var fullTunnelRoutes = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0).To4(), Mask: net.CIDRMask(1, 32)},
+	{IP: net.IPv4(128, 0, 0, 0).To4(), Mask: net.CIDRMask(1, 32)},
+}
+
 const (
 	//Queue from TUN -> router(server) / remote end (client)
 	pktInMaxBuff = 150
@@ -14,4 +23,6 @@ const (
 	servMaxInboundPktQueue = 400
 	//Queue out to each network client
 	servPerClientPktQueue = 200
+	//Packets buffered for a disconnected client, until it resumes its session
+	servSessionPktBuffer = 100
 )
@@ -0,0 +1,82 @@
+package subnet
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// serveControl accepts commands on a unix socket at path, one per line:
+// "retry" reconnects to the server immediately, and "status" reports the
+// state of the connection.
+func (c *Client) serveControl(path string) error {
+	// Remove a socket left behind by a previous run, but nothing else.
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	c.control = l
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go c.handleControl(conn)
+		}
+	}()
+	return nil
+}
+
+func (c *Client) handleControl(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		switch strings.TrimSpace(scanner.Text()) {
+		case "retry":
+			c.reestablish()
+			fmt.Fprintln(conn, "ok")
+		case "status":
+			if c.connectionOk {
+				fmt.Fprintf(conn, "connected to %s\n", c.servers[c.activeServer])
+			} else {
+				fmt.Fprintln(conn, "reconnecting")
+			}
+		default:
+			fmt.Fprintln(conn, "unknown command, expected retry or status")
+		}
+	}
+}
+
+// ControlCommand sends a command to the control socket of a running client,
+// returning its response.
+func ControlCommand(path, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return "", err
+	}
+	resp, err := bufio.NewReader(conn).ReadString('\n')
+	return strings.TrimSpace(resp), err
+}
@@ -2,6 +2,7 @@ package subnet
 
 import (
 	"net"
+	"time"
 
 	"github.com/songgao/water/waterutil"
 )
@@ -11,6 +12,9 @@ type IPPacket struct {
 	Raw      []byte
 	Dest     net.IP
 	Protocol waterutil.IPProtocol
+
+	enqueued time.Time
+	identity string // of the sending client, for packets forwarded over peer links
 }
 
 type inboundIPPkt struct {
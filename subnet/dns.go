@@ -0,0 +1,38 @@
+package subnet
+
+import (
+	"net"
+	"strings"
+)
+
+// DNSConfig describes the DNS servers & search domains which should be used
+// while connected to the VPN. It is sent by the server to each client.
+type DNSConfig struct {
+	Servers []net.IP
+	Search  []string
+}
+
+// Empty returns true if the config specifies no servers or search domains.
+func (c *DNSConfig) Empty() bool {
+	return c == nil || (len(c.Servers) == 0 && len(c.Search) == 0)
+}
+
+func (c *DNSConfig) String() string {
+	var servers []string
+	for _, s := range c.Servers {
+		servers = append(servers, s.String())
+	}
+	return "servers [" + strings.Join(servers, " ") + "] search [" + strings.Join(c.Search, " ") + "]"
+}
+
+// resolvConf returns the contents of a resolv.conf file for the config.
+func (c *DNSConfig) resolvConf() string {
+	out := "# Generated by subnet - the original is restored on exit.\n"
+	for _, s := range c.Servers {
+		out += "nameserver " + s.String() + "\n"
+	}
+	if len(c.Search) > 0 {
+		out += "search " + strings.Join(c.Search, " ") + "\n"
+	}
+	return out
+}
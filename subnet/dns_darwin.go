@@ -0,0 +1,79 @@
+package subnet
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// dnsTargets returns a journal entry for each enabled network service,
+// capturing its current DNS servers & search domains so they can be restored.
+func dnsTargets(iName string) ([]journalEntry, error) {
+	out, err := exec.Command("networksetup", "-listallnetworkservices").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []journalEntry
+	for i, service := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		// The first line is a notice, and disabled services are prefixed with '*'.
+		if i == 0 || service == "" || strings.HasPrefix(service, "*") {
+			continue
+		}
+		servers, err := networksetupList("-getdnsservers", service)
+		if err != nil {
+			return nil, err
+		}
+		search, err := networksetupList("-getsearchdomains", service)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, journalEntry{Kind: "dns", Backend: "networksetup", Dev: service, Servers: servers, Search: search})
+	}
+	return entries, nil
+}
+
+// networksetupList returns the values listed by a networksetup query, which
+// prints a sentence rather than a value if there are none.
+func networksetupList(query, service string) ([]string, error) {
+	out, err := exec.Command("networksetup", query, service).Output()
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(string(out), " aren't any ") {
+		return nil, nil
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// applyDNS configures the network service described by e. Services have no
+// notion of routing queries by domain, so routeAll has no effect.
+func applyDNS(e journalEntry, c *DNSConfig, routeAll bool, debug bool) error {
+	if len(c.Servers) > 0 {
+		args := []string{"-setdnsservers", e.Dev}
+		for _, s := range c.Servers {
+			args = append(args, s.String())
+		}
+		if err := commandExec("networksetup", args, debug); err != nil {
+			return err
+		}
+	}
+	if len(c.Search) > 0 {
+		return commandExec("networksetup", append([]string{"-setsearchdomains", e.Dev}, c.Search...), debug)
+	}
+	return nil
+}
+
+// undoDNS restores the DNS configuration captured in e.
+func undoDNS(e journalEntry) error {
+	servers, search := e.Servers, e.Search
+	if len(servers) == 0 {
+		servers = []string{"Empty"}
+	}
+	if len(search) == 0 {
+		search = []string{"Empty"}
+	}
+	if err := commandExec("networksetup", append([]string{"-setdnsservers", e.Dev}, servers...), true); err != nil {
+		return err
+	}
+	return commandExec("networksetup", append([]string{"-setsearchdomains", e.Dev}, search...), true)
+}
@@ -0,0 +1,107 @@
+package subnet
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const resolvConfPath = "/etc/resolv.conf"
+
+// dnsTargets returns a journal entry for each place DNS configuration needs to
+// be changed, capturing the current state so it can be restored. If
+// systemd-resolved is running, DNS is configured on the tunnel interface with
+// resolvectl, otherwise resolv.conf is rewritten.
+func dnsTargets(iName string) ([]journalEntry, error) {
+	if _, err := exec.LookPath("resolvectl"); err == nil {
+		if _, err := os.Stat("/run/systemd/resolve"); err == nil {
+			return []journalEntry{{Kind: "dns", Backend: "resolvectl", Dev: iName}}, nil
+		}
+	}
+
+	e := journalEntry{Kind: "dns", Backend: "resolvconf", Dev: resolvConfPath}
+	fi, err := os.Lstat(resolvConfPath)
+	switch {
+	case os.IsNotExist(err):
+		e.Absent = true
+	case err != nil:
+		return nil, err
+	case fi.Mode()&os.ModeSymlink != 0:
+		// Managed by another service (such as NetworkManager), whose file
+		// must not be overwritten.
+		if e.Link, err = os.Readlink(resolvConfPath); err != nil {
+			return nil, err
+		}
+	default:
+		d, err := ioutil.ReadFile(resolvConfPath)
+		if err != nil {
+			return nil, err
+		}
+		e.Data = string(d)
+	}
+	return []journalEntry{e}, nil
+}
+
+// applyDNS configures the target described by e. If routeAll is set, all
+// queries are sent to the configured servers, rather than just those for the
+// search domains.
+func applyDNS(e journalEntry, c *DNSConfig, routeAll bool, debug bool) error {
+	if e.Backend == "resolvectl" {
+		if len(c.Servers) > 0 {
+			args := []string{"dns", e.Dev}
+			for _, s := range c.Servers {
+				args = append(args, s.String())
+			}
+			if err := commandExec("resolvectl", args, debug); err != nil {
+				return err
+			}
+		}
+		domains := append([]string{"domain", e.Dev}, c.Search...)
+		if routeAll {
+			domains = append(domains, "~.")
+		}
+		if len(domains) > 2 {
+			return commandExec("resolvectl", domains, debug)
+		}
+		return nil
+	}
+
+	return replaceFile(e.Dev, func(tmp string) error {
+		return ioutil.WriteFile(tmp, []byte(c.resolvConf()), 0644)
+	})
+}
+
+// undoDNS restores the DNS configuration captured in e.
+func undoDNS(e journalEntry) error {
+	if e.Backend == "resolvectl" {
+		return commandExec("resolvectl", []string{"revert", e.Dev}, true)
+	}
+	switch {
+	case e.Absent:
+		if err := os.Remove(e.Dev); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	case e.Link != "":
+		return replaceFile(e.Dev, func(tmp string) error { return os.Symlink(e.Link, tmp) })
+	}
+	return replaceFile(e.Dev, func(tmp string) error {
+		return ioutil.WriteFile(tmp, []byte(e.Data), 0644)
+	})
+}
+
+// replaceFile atomically replaces path (rather than the target, if it is a
+// symlink) with the file created by create at a temporary path.
+func replaceFile(path string, create func(tmp string) error) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".subnet")
+	os.Remove(tmp)
+	if err := create(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package subnet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	dnsPort           = 53
+	dnsTTL            = 60
+	dnsForwardTimeout = 5 * time.Second
+
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+)
+
+// dnsResponder answers DNS queries on the server's VPN address. Names of
+// connected clients under zone are resolved to their addresses (and back),
+// and all other queries are forwarded to an upstream resolver.
+type dnsResponder struct {
+	zone     string // lower-case, with a trailing dot
+	upstream string
+	conn     *net.UDPConn
+	server   *Server
+}
+
+// dnsQuestion is the (single) question of a DNS query.
+type dnsQuestion struct {
+	name   string // lower-case, with a trailing dot
+	qtype  uint16
+	qclass uint16
+	end    int // offset of the end of the question in the message
+}
+
+func newDNSResponder(s *Server, zone, upstream string) (*dnsResponder, error) {
+	if upstream == "" {
+		upstream = systemNameserver()
+	} else if _, _, err := net.SplitHostPort(upstream); err != nil {
+		upstream = net.JoinHostPort(upstream, "53")
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: s.localAddr, Port: dnsPort})
+	if err != nil {
+		return nil, err
+	}
+	return &dnsResponder{
+		zone:     strings.ToLower(strings.Trim(zone, ".")) + ".",
+		upstream: upstream,
+		conn:     conn,
+		server:   s,
+	}, nil
+}
+
+func (d *dnsResponder) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !d.server.isShuttingDown {
+				log.Printf("DNS read error: %s\n", err.Error())
+			}
+			return
+		}
+		req := make([]byte, n)
+		copy(req, buf[:n])
+		go d.handle(req, from)
+	}
+}
+
+func (d *dnsResponder) handle(req []byte, from *net.UDPAddr) {
+	q, err := parseDNSQuestion(req)
+	if err != nil {
+		return
+	}
+
+	var resp []byte
+	if q.qclass == dnsClassIN && d.authoritative(q.name) {
+		rcode, answers := d.resolve(q)
+		resp = dnsReply(req, q, rcode, answers)
+	} else if d.upstream == "" {
+		resp = dnsReply(req, q, dnsRcodeServFail, nil)
+	} else if resp, err = d.forward(req); err != nil {
+		log.Printf("DNS forward of %s to %s failed: %s\n", q.name, d.upstream, err.Error())
+		resp = dnsReply(req, q, dnsRcodeServFail, nil)
+	}
+	d.conn.WriteToUDP(resp, from)
+}
+
+// authoritative returns true if name is in the zone, or is the reverse
+// name of an address within the VPN network.
+func (d *dnsResponder) authoritative(name string) bool {
+	if name == d.zone || strings.HasSuffix(name, "."+d.zone) {
+		return true
+	}
+	ip := reverseNameIP(name)
+	return ip != nil && d.server.localNetMask.Contains(ip)
+}
+
+// resolve answers a query for a name in the zone from the connected clients.
+func (d *dnsResponder) resolve(q dnsQuestion) (int, [][]byte) {
+	s := d.server
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	if ip := reverseNameIP(q.name); ip != nil {
+		id, ok := s.clientIDByAddress[ip.String()]
+		if !ok || s.clients[id] == nil {
+			return dnsRcodeNXDomain, nil
+		}
+		if q.qtype != dnsTypePTR {
+			return 0, nil
+		}
+		return 0, [][]byte{dnsRecord(dnsTypePTR, encodeDNSName(dnsLabel(s.clients[id].identity)+"."+d.zone))}
+	}
+
+	found := false
+	var answers [][]byte
+	for addr, id := range s.clientIDByAddress {
+		c := s.clients[id]
+		if c == nil || dnsLabel(c.identity)+"."+d.zone != q.name {
+			continue
+		}
+		found = true
+		ip := net.ParseIP(addr)
+		if ip4 := ip.To4(); ip4 != nil && q.qtype == dnsTypeA {
+			answers = append(answers, dnsRecord(dnsTypeA, ip4))
+		} else if ip4 == nil && q.qtype == dnsTypeAAAA {
+			answers = append(answers, dnsRecord(dnsTypeAAAA, ip.To16()))
+		}
+	}
+	if !found {
+		return dnsRcodeNXDomain, nil
+	}
+	return 0, answers
+}
+
+// forward relays the query to the upstream resolver, returning its response.
+func (d *dnsResponder) forward(req []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", d.upstream, dnsForwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsForwardTimeout))
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Close stops the responder.
+func (d *dnsResponder) Close() error {
+	return d.conn.Close()
+}
+
+func parseDNSQuestion(msg []byte) (dnsQuestion, error) {
+	var q dnsQuestion
+	if len(msg) < 12 || msg[2]&0x80 != 0 || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return q, errors.New("not a query with one question")
+	}
+
+	var labels []string
+	i := 12
+	for {
+		if i >= len(msg) {
+			return q, errors.New("truncated name")
+		}
+		l := int(msg[i])
+		i++
+		if l == 0 {
+			break
+		}
+		if l > 63 || i+l > len(msg) {
+			return q, errors.New("invalid label")
+		}
+		labels = append(labels, strings.ToLower(string(msg[i:i+l])))
+		i += l
+	}
+	if i+4 > len(msg) {
+		return q, errors.New("truncated question")
+	}
+	q.name = strings.Join(labels, ".") + "."
+	q.qtype = binary.BigEndian.Uint16(msg[i : i+2])
+	q.qclass = binary.BigEndian.Uint16(msg[i+2 : i+4])
+	q.end = i + 4
+	return q, nil
+}
+
+// dnsReply builds the response to req, containing the given answer records.
+func dnsReply(req []byte, q dnsQuestion, rcode int, answers [][]byte) []byte {
+	out := make([]byte, 12, 512)
+	copy(out[0:2], req[0:2])
+	flags := binary.BigEndian.Uint16(req[2:4])&0x7900 | 0x8000 | 0x0080 | uint16(rcode) // opcode & RD, QR, RA
+	if rcode != dnsRcodeServFail {
+		flags |= 0x0400 // AA
+	}
+	binary.BigEndian.PutUint16(out[2:4], flags)
+	binary.BigEndian.PutUint16(out[4:6], 1)
+	binary.BigEndian.PutUint16(out[6:8], uint16(len(answers)))
+	out = append(out, req[12:q.end]...)
+	for _, a := range answers {
+		out = append(out, a...)
+	}
+	return out
+}
+
+// dnsRecord encodes a resource record for the name in the question.
+func dnsRecord(typ uint16, data []byte) []byte {
+	rr := make([]byte, 12, 12+len(data))
+	binary.BigEndian.PutUint16(rr[0:2], 0xc000|12) // pointer to the question name
+	binary.BigEndian.PutUint16(rr[2:4], typ)
+	binary.BigEndian.PutUint16(rr[4:6], dnsClassIN)
+	binary.BigEndian.PutUint32(rr[6:10], dnsTTL)
+	binary.BigEndian.PutUint16(rr[10:12], uint16(len(data)))
+	return append(rr, data...)
+}
+
+func encodeDNSName(name string) []byte {
+	var out []byte
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		out = append(out, byte(len(l)))
+		out = append(out, l...)
+	}
+	return append(out, 0)
+}
+
+// dnsLabel converts a client identity into a valid DNS label.
+func dnsLabel(identity string) string {
+	b := []byte(strings.ToLower(identity))
+	for i, c := range b {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			b[i] = '-'
+		}
+	}
+	l := strings.Trim(string(b), "-")
+	if len(l) > 63 {
+		l = l[:63]
+	}
+	return l
+}
+
+// reverseNameIP returns the address represented by a name under in-addr.arpa
+// or ip6.arpa, or nil.
+func reverseNameIP(name string) net.IP {
+	if strings.HasSuffix(name, ".in-addr.arpa.") {
+		parts := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(parts) != 4 {
+			return nil
+		}
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+		return net.ParseIP(strings.Join(parts, ".")).To4()
+	}
+	if strings.HasSuffix(name, ".ip6.arpa.") {
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		var hex string
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			hex += nibbles[i]
+			if i%4 == 0 && i > 0 {
+				hex += ":"
+			}
+		}
+		return net.ParseIP(hex)
+	}
+	return nil
+}
+
+// systemNameserver returns the address of the first nameserver in
+// resolv.conf, or the empty string.
+func systemNameserver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,19 @@
+package subnet
+
+import "log"
+
+// Kinds of events emitted by the server.
+const (
+	EventQuotaThrottled    = "quota-throttled"
+	EventQuotaDisconnected = "quota-disconnected"
+	EventAuthFailed        = "auth-failed"
+)
+
+// emitEvent logs an event concerning the client identity, and runs the
+// configured event command (if any) with the kind, identity & detail as arguments.
+func (s *Server) emitEvent(kind, identity, detail string) {
+	log.Printf("Event %s for %q: %s\n", kind, identity, detail)
+	if s.eventCmd != "" {
+		go commandExec(s.eventCmd, []string{kind, identity, detail}, false)
+	}
+}
@@ -0,0 +1,187 @@
+package subnet
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ways a client orders the servers it may connect to.
+const (
+	// ServerSelectionPriority prefers servers in the order given.
+	ServerSelectionPriority = "priority"
+	// ServerSelectionLatency prefers servers with the lowest connect latency,
+	// measured at startup.
+	ServerSelectionLatency = "latency"
+)
+
+const (
+	// failoverAttempts is the number of times the client tries to reconnect
+	// to the active server before failing over to another.
+	failoverAttempts = 3
+	// failbackInterval is how often a client connected to a less-preferred
+	// server checks whether a more-preferred one is healthy.
+	failbackInterval = 30 * time.Second
+	// failbackProbes is the number of consecutive successful health checks
+	// before the client fails back to a more-preferred server.
+	failbackProbes = 3
+	probeTimeout   = 5 * time.Second
+)
+
+// serverAddr is a server the client may connect to.
+type serverAddr struct {
+	addr string // host:port dialled, with the host resolved unless via a proxy
+	host string // as given, for TLS & WebSocket host names
+	port int
+}
+
+func (s *serverAddr) String() string {
+	return s.addr
+}
+
+// resolveServers parses a comma-separated list of server hosts (each
+// optionally with a port), in the order given. If resolve is set, each host
+// is resolved to all of its IPv4 addresses, which are also returned as TCP
+// addresses, as the tunnel and the routes bypassing it are IPv4 only.
+// Otherwise the host names are kept, to be resolved by a proxy.
+func resolveServers(list, defaultPort string, resolve bool) ([]*serverAddr, []*net.TCPAddr, error) {
+	var out []*serverAddr
+	var tcpAddrs []*net.TCPAddr
+	for _, server := range strings.Split(list, ",") {
+		if server == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			host, port = server, defaultPort
+		}
+		portNum, err := net.LookupPort("tcp", port)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !resolve {
+			out = append(out, &serverAddr{addr: net.JoinHostPort(host, strconv.Itoa(portNum)), host: host, port: portNum})
+			continue
+		}
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			return nil, nil, err
+		}
+		found := false
+		for _, addr := range addrs {
+			if addr.To4() == nil {
+				continue
+			}
+			a := &net.TCPAddr{IP: addr.To4(), Port: portNum}
+			out = append(out, &serverAddr{addr: a.String(), host: host, port: portNum})
+			tcpAddrs = append(tcpAddrs, a)
+			found = true
+		}
+		if !found {
+			return nil, nil, errors.New("No IPv4 address for " + host)
+		}
+	}
+	if len(out) == 0 {
+		return nil, nil, errors.New("Could not resolve " + list)
+	}
+	return out, tcpAddrs, nil
+}
+
+// orderByLatency sorts servers by the time taken to open a TCP connection to
+// them. Unreachable servers are placed last.
+func orderByLatency(servers []*serverAddr, dial dialFunc) {
+	latency := map[*serverAddr]time.Duration{}
+	type result struct {
+		server  *serverAddr
+		latency time.Duration
+	}
+	results := make(chan result)
+	for _, s := range servers {
+		go func(s *serverAddr) {
+			d, err := probeServer(s, dial)
+			if err != nil {
+				d = probeTimeout * 2
+			}
+			results <- result{s, d}
+		}(s)
+	}
+	for range servers {
+		r := <-results
+		latency[r.server] = r.latency
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		return latency[servers[i]] < latency[servers[j]]
+	})
+	for _, s := range servers {
+		log.Printf("Server %s: connect latency %s\n", s, latency[s])
+	}
+}
+
+// probeServer returns the time taken to open a TCP connection to server.
+func probeServer(server *serverAddr, dial dialFunc) (time.Duration, error) {
+	start := time.Now()
+	conn, err := dial(server.String(), probeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start), nil
+}
+
+// connect connects to the most preferred server which is available.
+func (c *Client) connect() error {
+	var err error
+	for i := range c.servers {
+		if err = c.connectTo(i); err == nil {
+			return nil
+		}
+		log.Printf("Could not connect to %s: %s\n", c.servers[i], err.Error())
+	}
+	return err
+}
+
+// reconnect re-establishes the connection after a failure. The active server
+// is retried until failoverAttempts is reached, then all servers are tried in
+// order of preference.
+func (c *Client) reconnect(attempt int) error {
+	if target := c.failbackTo; target >= 0 {
+		c.failbackTo = -1
+		if err := c.connectTo(target); err == nil {
+			return nil
+		}
+	}
+	if attempt < failoverAttempts || len(c.servers) == 1 {
+		return c.connectTo(c.activeServer)
+	}
+	return c.connect()
+}
+
+// failbackRoutine moves the connection back to a more-preferred server once
+// it has been healthy for failbackProbes consecutive checks.
+func (c *Client) failbackRoutine() {
+	healthy := make([]int, len(c.servers))
+	for !c.isShuttingDown {
+		time.Sleep(failbackInterval)
+		if !c.connectionOk || c.activeServer == 0 {
+			continue
+		}
+
+		for i := 0; i < c.activeServer; i++ {
+			if _, err := probeServer(c.servers[i], c.dial); err != nil {
+				healthy[i] = 0
+				continue
+			}
+			if healthy[i]++; healthy[i] >= failbackProbes {
+				log.Printf("Server %s is healthy again, failing back.\n", c.servers[i])
+				healthy = make([]int, len(c.servers))
+				c.failbackTo = i
+				c.tlsConn.Close() // reconnects via connectionProblem()
+				break
+			}
+		}
+	}
+}
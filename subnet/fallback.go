@@ -0,0 +1,59 @@
+package subnet
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/twitchyliquid64/subnet/subnet/conn"
+)
+
+const fallbackDialTimeout = 10 * time.Second
+
+// routeConns returns a connection handler for a port shared with another
+// service, such as a web server. The TLS ClientHello of each connection is
+// read: connections which negotiate subnet's ALPN protocol, or ask for one of
+// serverNames, are passed to handle. All others are proxied to fallback.
+func routeConns(handle func(net.Conn), fallback string, serverNames []string) func(net.Conn) {
+	return func(rawConn net.Conn) {
+		c, hello, err := conn.PeekClientHello(rawConn)
+		if err == nil && isVPNHello(hello, serverNames) {
+			handle(c)
+			return
+		}
+		proxyConn(c, fallback)
+	}
+}
+
+func isVPNHello(hello *tls.ClientHelloInfo, serverNames []string) bool {
+	for _, p := range hello.SupportedProtos {
+		if p == conn.ALPNProtocol {
+			return true
+		}
+	}
+	for _, name := range serverNames {
+		if hello.ServerName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn relays c to the service at addr, until either side closes.
+func proxyConn(c net.Conn, addr string) {
+	defer c.Close()
+	backend, err := net.DialTimeout("tcp", addr, fallbackDialTimeout)
+	if err != nil {
+		log.Printf("Could not connect to fallback %s for %s: %s\n", addr, c.RemoteAddr().String(), err.Error())
+		return
+	}
+	defer backend.Close()
+
+	go func() {
+		io.Copy(backend, c)
+		backend.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(c, backend)
+}
@@ -0,0 +1,377 @@
+package subnet
+
+import (
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/twitchyliquid64/subnet/subnet/cert"
+	"github.com/twitchyliquid64/subnet/subnet/conn"
+)
+
+const (
+	// peerPort is the route() source of packets forwarded by a peer server.
+	peerPort = -3
+
+	peerRedialInterval = 10 * time.Second
+	peerWriteTimeout   = 10 * time.Second
+)
+
+// federation links a server to peer servers over authenticated TLS links.
+// Each server advertises the addresses of its connected clients to its peers,
+// withdrawing them when clients disconnect, and packets for addresses
+// advertised by a peer are forwarded to it rather than the TUN device.
+//
+// Packets received from a peer are never forwarded to another peer, so the
+// servers must be fully meshed.
+type federation struct {
+	server   *Server
+	tlsConf  *tls.Config
+	listener net.Listener
+	peers    []string
+
+	lock   sync.RWMutex
+	links  map[*peerLink]bool
+	local  map[string]bool       // prefixes advertised to peers
+	routes map[[4]byte]*peerLink // client addresses advertised by peers
+}
+
+// peerPacket is an IP packet forwarded over a peer link, with the identity of
+// the client which sent it, so the receiving server can apply -isolate. The
+// identity is empty for packets from the peer's TUN device.
+type peerPacket struct {
+	Packet   *IPPacket
+	Identity string
+}
+
+// peerLink is a connection to a peer server.
+type peerLink struct {
+	conn     net.Conn
+	name     string
+	fed      *federation
+	encoder  *gob.Encoder
+	encLock  sync.Mutex
+	outbound *packetQueue
+	addrs    map[[4]byte]bool // advertised by the peer, guarded by fed.lock
+	done     chan struct{}
+	closed   bool
+
+	// Route updates waiting to be sent, guarded by fed.lock so they are
+	// queued in order. routesReady is signalled when one is queued.
+	routes      []routeUpdate
+	routesReady chan struct{}
+}
+
+type routeUpdate struct {
+	kind     conn.PktType
+	prefixes []string
+}
+
+func newFederation(s *Server, certPemPath, keyPemPath, peerCAPath, listenAddr string, peers []string) (*federation, error) {
+	if peerCAPath == "" {
+		return nil, errors.New("a CA is required to authenticate peers")
+	}
+	tlsConf, err := conn.TLSConfig(certPemPath, keyPemPath, peerCAPath)
+	if err != nil {
+		return nil, err
+	}
+	f := &federation{
+		server:  s,
+		tlsConf: tlsConf,
+		peers:   peers,
+		links:   map[*peerLink]bool{},
+		routes:  map[[4]byte]*peerLink{},
+		local:   map[string]bool{hostNet(s.localAddr).String(): true},
+	}
+	if listenAddr != "" {
+		if f.listener, err = net.Listen("tcp", listenAddr); err != nil {
+			return nil, err
+		}
+		log.Printf("Listen for peers on %s\n", listenAddr)
+	}
+	return f, nil
+}
+
+func (f *federation) run() {
+	if f.listener != nil {
+		go acceptRoutine(f.listener, f.handlePeer, &f.server.wg, &f.server.isShuttingDown)
+	}
+	for _, addr := range f.peers {
+		go f.dialRoutine(addr)
+	}
+}
+
+// dialRoutine maintains a link to the peer at addr, redialling whenever it
+// fails.
+func (f *federation) dialRoutine(addr string) {
+	for !f.server.isShuttingDown {
+		rawConn, err := net.DialTimeout("tcp", addr, peerWriteTimeout)
+		if err != nil {
+			log.Printf("Could not connect to peer %s: %s\n", addr, err.Error())
+		} else if tlsConn, err := conn.Handshake(rawConn, f.tlsConf, true, false); err != nil {
+			log.Printf("Handshake with peer %s failed: %s\n", addr, err.Error())
+		} else {
+			<-f.serveLink(tlsConn).done
+		}
+		time.Sleep(peerRedialInterval)
+	}
+}
+
+func (f *federation) handlePeer(rawConn net.Conn) {
+	tlsConn, err := conn.Handshake(rawConn, f.tlsConf, false, false)
+	if err != nil {
+		log.Printf("Handshake with peer %s failed: %s\n", rawConn.RemoteAddr().String(), err.Error())
+		return
+	}
+	f.serveLink(tlsConn)
+}
+
+// serveLink starts exchanging routes & packets over an established link.
+func (f *federation) serveLink(c net.Conn) *peerLink {
+	l := &peerLink{
+		conn:        c,
+		name:        c.RemoteAddr().String(),
+		fed:         f,
+		encoder:     gob.NewEncoder(c),
+		outbound:    newPacketQueue(servPerClientPktQueue, false),
+		addrs:       map[[4]byte]bool{},
+		done:        make(chan struct{}),
+		routesReady: make(chan struct{}, 1),
+	}
+	if peerCert := conn.PeerCertificate(c); peerCert != nil {
+		l.name = cert.Identity(peerCert) + " (" + l.name + ")"
+	}
+	log.Printf("Linked to peer %s\n", l.name)
+
+	f.lock.Lock()
+	f.links[l] = true
+	var prefixes []string
+	for p := range f.local {
+		prefixes = append(prefixes, p)
+	}
+	l.queueRoutes(conn.PktRouteAdvert, prefixes)
+	f.lock.Unlock()
+
+	go l.readRoutine()
+	go l.writeRoutine()
+	go l.routeRoutine()
+	return l
+}
+
+// advertise tells each peer that addrs are reachable via this server.
+func (f *federation) advertise(addrs ...net.IP) {
+	f.update(conn.PktRouteAdvert, addrs)
+}
+
+// withdraw tells each peer that addrs are no longer reachable via this server.
+func (f *federation) withdraw(addrs ...net.IP) {
+	f.update(conn.PktRouteWithdraw, addrs)
+}
+
+func (f *federation) update(kind conn.PktType, addrs []net.IP) {
+	if len(addrs) == 0 {
+		return
+	}
+	var prefixes []string
+	for _, addr := range addrs {
+		prefixes = append(prefixes, hostNet(addr).String())
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, p := range prefixes {
+		if kind == conn.PktRouteAdvert {
+			f.local[p] = true
+		} else {
+			delete(f.local, p)
+		}
+	}
+	for l := range f.links {
+		l.queueRoutes(kind, prefixes)
+	}
+}
+
+// lookup returns the peer advertising dest, or nil.
+func (f *federation) lookup(dest net.IP) *peerLink {
+	ip4 := dest.To4()
+	if ip4 == nil {
+		return nil
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.routes[[4]byte(ip4)]
+}
+
+func (f *federation) close() {
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for l := range f.links {
+		l.conn.Close()
+	}
+}
+
+// queueRoutes queues a route advertisement or withdrawal to be sent to the
+// peer. Must be called with fed.lock held.
+func (l *peerLink) queueRoutes(kind conn.PktType, prefixes []string) {
+	l.routes = append(l.routes, routeUpdate{kind: kind, prefixes: prefixes})
+	select {
+	case l.routesReady <- struct{}{}:
+	default:
+	}
+}
+
+// routeRoutine sends queued route updates, so writes to a slow peer don't
+// hold fed.lock.
+func (l *peerLink) routeRoutine() {
+	for {
+		select {
+		case <-l.routesReady:
+		case <-l.done:
+			return
+		}
+		l.fed.lock.Lock()
+		updates := l.routes
+		l.routes = nil
+		l.fed.lock.Unlock()
+
+		for _, u := range updates {
+			if err := l.send(u.kind, u.prefixes); err != nil {
+				log.Printf("Write error for peer %s: %s\n", l.name, err.Error())
+				l.hadError()
+				return
+			}
+		}
+	}
+}
+
+// send writes a route advertisement or withdrawal to the peer.
+func (l *peerLink) send(kind conn.PktType, prefixes []string) error {
+	l.encLock.Lock()
+	defer l.encLock.Unlock()
+	l.conn.SetWriteDeadline(time.Now().Add(peerWriteTimeout))
+	if err := l.encoder.Encode(kind); err != nil {
+		return err
+	}
+	return l.encoder.Encode(prefixes)
+}
+
+func (l *peerLink) queueIP(pkt *IPPacket) {
+	l.outbound.Enqueue(pkt)
+}
+
+func (l *peerLink) writeRoutine() {
+	for {
+		pkt, ok := l.outbound.Dequeue()
+		if !ok {
+			return
+		}
+		l.encLock.Lock()
+		l.conn.SetWriteDeadline(time.Now().Add(peerWriteTimeout))
+		l.encoder.Encode(conn.PktIPPkt)
+		err := l.encoder.Encode(peerPacket{Packet: pkt, Identity: pkt.identity})
+		l.encLock.Unlock()
+		if err != nil {
+			log.Printf("Write error for peer %s: %s\n", l.name, err.Error())
+			l.hadError()
+			return
+		}
+	}
+}
+
+func (l *peerLink) readRoutine() {
+	decoder := gob.NewDecoder(l.conn)
+	s := l.fed.server
+
+	for !s.isShuttingDown {
+		var pktType conn.PktType
+		if err := decoder.Decode(&pktType); err != nil {
+			if !s.isShuttingDown {
+				log.Printf("Peer %s read error: %s\n", l.name, err.Error())
+			}
+			l.hadError()
+			return
+		}
+
+		switch pktType {
+		case conn.PktRouteAdvert, conn.PktRouteWithdraw:
+			var prefixes []string
+			if err := decoder.Decode(&prefixes); err != nil {
+				log.Printf("Could not decode routes from peer %s: %s\n", l.name, err.Error())
+				l.hadError()
+				return
+			}
+			l.updateRoutes(pktType == conn.PktRouteAdvert, prefixes)
+
+		case conn.PktIPPkt:
+			var peerPkt peerPacket
+			if err := decoder.Decode(&peerPkt); err != nil || peerPkt.Packet == nil {
+				log.Printf("Could not decode IPPacket from peer %s: %v\n", l.name, err)
+				l.hadError()
+				return
+			}
+			peerPkt.Packet.identity = peerPkt.Identity
+			s.inboundIPPkts <- &inboundIPPkt{pkt: peerPkt.Packet, clientID: peerPort}
+
+		default:
+			log.Printf("Unexpected packet type %d from peer %s. Disconnecting.\n", pktType, l.name)
+			l.hadError()
+			return
+		}
+	}
+}
+
+// updateRoutes adds or removes routes advertised by the peer. Only routes to
+// single addresses on this server's network are accepted, other than its own.
+func (l *peerLink) updateRoutes(advert bool, prefixes []string) {
+	s := l.fed.server
+	l.fed.lock.Lock()
+	defer l.fed.lock.Unlock()
+	for _, p := range prefixes {
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			log.Printf("Ignoring invalid route %q from peer %s\n", p, l.name)
+			continue
+		}
+		if ones, bits := n.Mask.Size(); ones != bits || !s.localNetMask.Contains(n.IP) || n.IP.Equal(s.localAddr) {
+			log.Printf("Ignoring route %q from peer %s: not a client address on %s\n", p, l.name, s.localNetMask)
+			continue
+		}
+		addr := [4]byte(n.IP.To4())
+		if advert {
+			l.addrs[addr] = true
+			l.fed.routes[addr] = l
+		} else if l.addrs[addr] {
+			delete(l.addrs, addr)
+			if l.fed.routes[addr] == l {
+				delete(l.fed.routes, addr)
+			}
+		}
+	}
+}
+
+// hadError closes the link, withdrawing the routes learnt over it.
+func (l *peerLink) hadError() {
+	l.fed.lock.Lock()
+	defer l.fed.lock.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	l.conn.Close()
+	l.outbound.Close()
+	delete(l.fed.links, l)
+	for addr := range l.addrs {
+		if l.fed.routes[addr] == l {
+			delete(l.fed.routes, addr)
+		}
+	}
+	log.Printf("Lost link to peer %s, withdrew %d routes\n", l.name, len(l.addrs))
+	close(l.done)
+}
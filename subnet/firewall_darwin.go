@@ -0,0 +1,53 @@
+package subnet
+
+import (
+	"errors"
+	"net"
+)
+
+var errFirewallUnsupported = errors.New("firewall rules are only supported on linux")
+
+// FirewallBackend is not supported on darwin.
+func FirewallBackend() (string, error) {
+	return "", errFirewallUnsupported
+}
+
+// NATBackend is not supported on darwin.
+func NATBackend(network *net.IPNet) (string, error) {
+	return "", errFirewallUnsupported
+}
+
+// EnableKillSwitch is not supported on darwin.
+func EnableKillSwitch(backend, iName string, endpoints []*net.TCPAddr, allowNets []*net.IPNet, debug bool) error {
+	return errFirewallUnsupported
+}
+
+// DisableKillSwitch is not supported on darwin.
+func DisableKillSwitch(backend string, debug bool) error {
+	return errFirewallUnsupported
+}
+
+// SetKillSwitchAllowed is not supported on darwin.
+func SetKillSwitchAllowed(backend string, allowNets []*net.IPNet, debug bool) error {
+	return errFirewallUnsupported
+}
+
+// EnableTenantIsolation is not supported on darwin.
+func EnableTenantIsolation(backend string, ifaces []string, debug bool) error {
+	return errFirewallUnsupported
+}
+
+// DisableTenantIsolation is not supported on darwin.
+func DisableTenantIsolation(backend string, debug bool) error {
+	return errFirewallUnsupported
+}
+
+// EnableNAT is not supported on darwin.
+func EnableNAT(backend, tunnel, egress string, network *net.IPNet, debug bool) error {
+	return errFirewallUnsupported
+}
+
+// DisableNAT is not supported on darwin.
+func DisableNAT(backend, tunnel, egress string, network *net.IPNet, debug bool) error {
+	return errFirewallUnsupported
+}
@@ -0,0 +1,322 @@
+package subnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+const (
+	killSwitchTable = "subnet_killswitch"
+	killSwitchChain = "SUBNET-KILLSWITCH"
+	// killSwitchAllow is the chain holding the rules for allowNets, which
+	// SetKillSwitchAllowed replaces.
+	killSwitchAllow = "SUBNET-KILLSWITCH-LAN"
+	natTablePrefix  = "subnet_nat_"
+	tenantsTable    = "subnet_tenants"
+	tenantsChain    = "SUBNET-TENANTS"
+)
+
+// FirewallBackend returns "nft" if nftables is available, otherwise "iptables".
+func FirewallBackend() (string, error) {
+	if _, err := exec.LookPath("nft"); err == nil {
+		return "nft", nil
+	}
+	if _, err := exec.LookPath("iptables"); err == nil {
+		return "iptables", nil
+	}
+	return "", errors.New("neither nft nor iptables are installed")
+}
+
+// NATBackend returns the backend EnableNAT should use for network. An accept
+// in one nftables table does not override a drop in another, so if the
+// iptables FORWARD chain drops by default (as docker sets it up), the rules
+// are installed there with iptables instead. Other forward chains which drop
+// by default are reported as an error, as forwarding must be allowed in them.
+func NATBackend(network *net.IPNet) (string, error) {
+	backend, err := FirewallBackend()
+	if err != nil || backend != "nft" {
+		return backend, err
+	}
+	cmd := iptablesCmd(network.IP)
+	if _, err := exec.LookPath(cmd); err == nil {
+		if out, err := exec.Command(cmd, "-S", "FORWARD").Output(); err == nil && strings.HasPrefix(string(out), "-P FORWARD DROP") {
+			return "iptables", nil
+		}
+	}
+
+	out, err := exec.Command("nft", "-j", "list", "chains").Output()
+	if err != nil {
+		return "", fmt.Errorf("nft list chains: %v", err)
+	}
+	var ruleset struct {
+		Nftables []struct {
+			Chain *struct {
+				Family, Table, Name, Hook, Policy string
+			} `json:"chain"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(out, &ruleset); err != nil {
+		return "", fmt.Errorf("nft list chains: %v", err)
+	}
+	for _, o := range ruleset.Nftables {
+		if c := o.Chain; c != nil && c.Hook == "forward" && c.Policy == "drop" && !strings.HasPrefix(c.Table, "subnet_") {
+			return "", fmt.Errorf("nftables chain %s %s %s drops forwarded packets by default, allow forwarding from %s there", c.Family, c.Table, c.Name, network)
+		}
+	}
+	return backend, nil
+}
+
+// EnableKillSwitch installs firewall rules which drop all outbound traffic, except
+// traffic on loopback, traffic through the tunnel interface iName, traffic to
+// the server endpoints, and traffic to the networks in allowNets. DHCP and
+// IPv6 neighbour discovery are also permitted, so the physical interface
+// keeps its addresses.
+func EnableKillSwitch(backend, iName string, endpoints []*net.TCPAddr, allowNets []*net.IPNet, debug bool) error {
+	if backend == "nft" {
+		rules := []string{
+			fmt.Sprintf("add table inet %s", killSwitchTable),
+			fmt.Sprintf("add chain inet %s output { type filter hook output priority 0 ; policy drop ; }", killSwitchTable),
+			fmt.Sprintf("add rule inet %s output oifname \"lo\" accept", killSwitchTable),
+			fmt.Sprintf("add rule inet %s output oifname %q accept", killSwitchTable, iName),
+			fmt.Sprintf("add rule inet %s output udp sport 68 udp dport 67 accept", killSwitchTable),
+			fmt.Sprintf("add rule inet %s output udp sport 546 udp dport 547 accept", killSwitchTable),
+			fmt.Sprintf("add rule inet %s output icmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept", killSwitchTable),
+		}
+		for _, e := range endpoints {
+			rules = append(rules, fmt.Sprintf("add rule inet %s output %s daddr %s tcp dport %d accept", killSwitchTable, nftFamily(e.IP), e.IP, e.Port))
+		}
+		rules = append(rules,
+			fmt.Sprintf("add chain inet %s allow", killSwitchTable),
+			fmt.Sprintf("add rule inet %s output jump allow", killSwitchTable))
+		rules = append(rules, nftKillSwitchAllowRules(allowNets)...)
+		return commandExecInput("nft", []string{"-f", "-"}, strings.Join(rules, "\n")+"\n", debug)
+	}
+
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		v6 := cmd == "ip6tables"
+		rules := [][]string{
+			{"-N", killSwitchAllow},
+			{"-N", killSwitchChain},
+			{"-A", killSwitchChain, "-o", "lo", "-j", "ACCEPT"},
+			{"-A", killSwitchChain, "-o", iName, "-j", "ACCEPT"},
+		}
+		if v6 {
+			rules = append(rules, []string{"-A", killSwitchChain, "-p", "udp", "--sport", "546", "--dport", "547", "-j", "ACCEPT"})
+			for _, t := range []string{"router-solicitation", "neighbour-solicitation", "neighbour-advertisement"} {
+				rules = append(rules, []string{"-A", killSwitchChain, "-p", "ipv6-icmp", "--icmpv6-type", t, "-j", "ACCEPT"})
+			}
+		} else {
+			rules = append(rules, []string{"-A", killSwitchChain, "-p", "udp", "--sport", "68", "--dport", "67", "-j", "ACCEPT"})
+		}
+		for _, e := range endpoints {
+			if (e.IP.To4() == nil) == v6 {
+				rules = append(rules, []string{"-A", killSwitchChain, "-d", e.IP.String(), "-p", "tcp", "--dport", fmt.Sprint(e.Port), "-j", "ACCEPT"})
+			}
+		}
+		rules = append(rules, []string{"-A", killSwitchChain, "-j", killSwitchAllow})
+		rules = append(rules, iptablesKillSwitchAllowRules(allowNets, v6)...)
+		rules = append(rules, []string{"-A", killSwitchChain, "-j", "DROP"}, []string{"-I", "OUTPUT", "-j", killSwitchChain})
+
+		for _, args := range rules {
+			if err := commandExec(cmd, args, debug); err != nil {
+				DisableKillSwitch(backend, debug)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DisableKillSwitch removes the rules installed by EnableKillSwitch.
+func DisableKillSwitch(backend string, debug bool) error {
+	if backend == "nft" {
+		return commandExec("nft", []string{"delete", "table", "inet", killSwitchTable}, debug)
+	}
+
+	var firstErr error
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		for _, args := range [][]string{
+			{"-D", "OUTPUT", "-j", killSwitchChain},
+			{"-F", killSwitchChain},
+			{"-X", killSwitchChain},
+			{"-F", killSwitchAllow},
+			{"-X", killSwitchAllow},
+		} {
+			if err := commandExec(cmd, args, debug); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// SetKillSwitchAllowed replaces the networks which the kill switch installed
+// by EnableKillSwitch permits traffic to.
+func SetKillSwitchAllowed(backend string, allowNets []*net.IPNet, debug bool) error {
+	if backend == "nft" {
+		rules := append([]string{fmt.Sprintf("flush chain inet %s allow", killSwitchTable)}, nftKillSwitchAllowRules(allowNets)...)
+		return commandExecInput("nft", []string{"-f", "-"}, strings.Join(rules, "\n")+"\n", debug)
+	}
+
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		rules := append([][]string{{"-F", killSwitchAllow}}, iptablesKillSwitchAllowRules(allowNets, cmd == "ip6tables")...)
+		for _, args := range rules {
+			if err := commandExec(cmd, args, debug); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func nftKillSwitchAllowRules(allowNets []*net.IPNet) []string {
+	var rules []string
+	for _, n := range allowNets {
+		rules = append(rules, fmt.Sprintf("add rule inet %s allow %s daddr %s accept", killSwitchTable, nftFamily(n.IP), n))
+	}
+	return rules
+}
+
+func iptablesKillSwitchAllowRules(allowNets []*net.IPNet, v6 bool) [][]string {
+	var rules [][]string
+	for _, n := range allowNets {
+		if (n.IP.To4() == nil) == v6 {
+			rules = append(rules, []string{"-A", killSwitchAllow, "-d", n.String(), "-j", "ACCEPT"})
+		}
+	}
+	return rules
+}
+
+// EnableTenantIsolation installs firewall rules which drop traffic forwarded
+// between any two of the interfaces ifaces, so clients of one tenant cannot
+// reach another through the kernel.
+func EnableTenantIsolation(backend string, ifaces []string, debug bool) error {
+	if backend == "nft" {
+		rules := []string{
+			fmt.Sprintf("add table inet %s", tenantsTable),
+			fmt.Sprintf("add chain inet %s forward { type filter hook forward priority -10 ; }", tenantsTable),
+		}
+		for _, in := range ifaces {
+			for _, out := range ifaces {
+				if in != out {
+					rules = append(rules, fmt.Sprintf("add rule inet %s forward iifname %q oifname %q drop", tenantsTable, in, out))
+				}
+			}
+		}
+		return commandExecInput("nft", []string{"-f", "-"}, strings.Join(rules, "\n")+"\n", debug)
+	}
+
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		rules := [][]string{{"-N", tenantsChain}}
+		for _, in := range ifaces {
+			for _, out := range ifaces {
+				if in != out {
+					rules = append(rules, []string{"-A", tenantsChain, "-i", in, "-o", out, "-j", "DROP"})
+				}
+			}
+		}
+		rules = append(rules, []string{"-I", "FORWARD", "-j", tenantsChain})
+
+		for _, args := range rules {
+			if err := commandExec(cmd, args, debug); err != nil {
+				DisableTenantIsolation(backend, debug)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DisableTenantIsolation removes the rules installed by EnableTenantIsolation.
+func DisableTenantIsolation(backend string, debug bool) error {
+	if backend == "nft" {
+		return commandExec("nft", []string{"delete", "table", "inet", tenantsTable}, debug)
+	}
+
+	var firstErr error
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		for _, args := range [][]string{
+			{"-D", "FORWARD", "-j", tenantsChain},
+			{"-F", tenantsChain},
+			{"-X", tenantsChain},
+		} {
+			if err := commandExec(cmd, args, debug); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// EnableNAT installs firewall rules which masquerade traffic from network as it
+// leaves via the egress interface, and permit forwarding between the tunnel
+// interface and egress.
+func EnableNAT(backend, tunnel, egress string, network *net.IPNet, debug bool) error {
+	if backend == "nft" {
+		family, table := nftFamily(network.IP), natTablePrefix+tunnel
+		rules := []string{
+			fmt.Sprintf("add table %s %s", family, table),
+			fmt.Sprintf("add chain %s %s postrouting { type nat hook postrouting priority 100 ; }", family, table),
+			fmt.Sprintf("add rule %s %s postrouting %s saddr %s oifname %q masquerade", family, table, family, network, egress),
+			fmt.Sprintf("add chain %s %s forward { type filter hook forward priority 0 ; }", family, table),
+			fmt.Sprintf("add rule %s %s forward iifname %q oifname %q accept", family, table, tunnel, egress),
+			fmt.Sprintf("add rule %s %s forward iifname %q oifname %q ct state related,established accept", family, table, egress, tunnel),
+		}
+		return commandExecInput("nft", []string{"-f", "-"}, strings.Join(rules, "\n")+"\n", debug)
+	}
+
+	cmd := iptablesCmd(network.IP)
+	for i, rule := range natRules(tunnel, egress, network) {
+		if err := commandExec(cmd, append([]string{"-t", rule[0], "-I"}, rule[1:]...), debug); err != nil {
+			for _, added := range natRules(tunnel, egress, network)[:i] {
+				commandExec(cmd, append([]string{"-t", added[0], "-D"}, added[1:]...), debug)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// DisableNAT removes the rules installed by EnableNAT.
+func DisableNAT(backend, tunnel, egress string, network *net.IPNet, debug bool) error {
+	if backend == "nft" {
+		return commandExec("nft", []string{"delete", "table", nftFamily(network.IP), natTablePrefix + tunnel}, debug)
+	}
+
+	var firstErr error
+	cmd := iptablesCmd(network.IP)
+	for _, rule := range natRules(tunnel, egress, network) {
+		if err := commandExec(cmd, append([]string{"-t", rule[0], "-D"}, rule[1:]...), debug); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// natRules returns the iptables rules installed by EnableNAT, each prefixed by
+// the table it belongs in.
+func natRules(tunnel, egress string, network *net.IPNet) [][]string {
+	return [][]string{
+		{"nat", "POSTROUTING", "-s", network.String(), "-o", egress, "-j", "MASQUERADE"},
+		{"filter", "FORWARD", "-i", tunnel, "-o", egress, "-j", "ACCEPT"},
+		{"filter", "FORWARD", "-i", egress, "-o", tunnel, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+}
+
+func iptablesCmd(ip net.IP) string {
+	if ip.To4() != nil {
+		return "iptables"
+	}
+	return "ip6tables"
+}
+
+func nftFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip"
+	}
+	return "ip6"
+}
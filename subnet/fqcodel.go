@@ -0,0 +1,384 @@
+package subnet
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// Parameters of the flow queueing & CoDel algorithms, from RFC 8290.
+const (
+	fqFlowBuckets = 1024
+	fqQuantum     = devMtuSize
+
+	codelTarget   = 5 * time.Millisecond
+	codelInterval = 100 * time.Millisecond
+
+	// The interactive band has priority for up to interactiveRate bytes per
+	// second (with bursts of interactiveBurst), as the DSCP is set by clients.
+	// Beyond it, the bulk band is dequeued first, so a client marking all its
+	// traffic cannot starve others (like the tin thresholds of CAKE).
+	interactiveRate  = 1024 * 1024
+	interactiveBurst = 64 * 1024
+)
+
+// Queue bands, dequeued in strict priority order.
+const (
+	bandInteractive = iota
+	bandBulk
+	numBands
+)
+
+// interactiveDSCP lists the DSCP code points given strict priority:
+// CS5, EF, CS6, CS7, AF4x, and AF2x (used by OpenSSH for interactive sessions).
+var interactiveDSCP = map[byte]bool{
+	40: true, 46: true, 48: true, 56: true,
+	34: true, 36: true, 38: true,
+	18: true, 20: true, 22: true,
+}
+
+// QueueStats describes the packets which have passed through a queue.
+type QueueStats struct {
+	Backlog   int // packets currently queued
+	Enqueued  uint64
+	Dropped   uint64 // packets dropped by CoDel
+	Overlimit uint64 // packets dropped as the queue was full
+	AvgDelay  time.Duration
+	MaxDelay  time.Duration
+}
+
+// packetQueue schedules packets fairly between flows (hashed from the IP 5-tuple),
+// and drops packets from flows which are building a standing queue (CoDel). Packets
+// marked with an interactive DSCP are dequeued first, up to interactiveRate.
+// A flow stays in the band it was queued in until its queue empties, so its
+// packets are never reordered.
+type packetQueue struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	count  int
+	closed bool
+	woken  bool
+	layer2 bool // packets are ethernet frames
+
+	bands       [numBands]fqBand
+	interactive *tokenBucket
+	stats       QueueStats
+}
+
+type fqBand struct {
+	flows    [fqFlowBuckets]codelFlow
+	newFlows []*codelFlow
+	oldFlows []*codelFlow
+}
+
+type codelFlow struct {
+	pkts    []*IPPacket
+	bytes   int
+	deficit int
+	active  bool
+
+	// CoDel state.
+	firstAboveTime time.Time
+	dropNext       time.Time
+	dropCount      int
+	lastCount      int
+	dropping       bool
+}
+
+// newPacketQueue returns a queue holding at most limit packets. If layer2 is
+// set, packets are ethernet frames, and are classified by the IP packet within.
+func newPacketQueue(limit int, layer2 bool) *packetQueue {
+	q := &packetQueue{limit: limit, layer2: layer2, interactive: newTokenBucket(interactiveRate, interactiveBurst)}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// Enqueue adds pkt to the queue, returning false if the queue was closed.
+func (q *packetQueue) Enqueue(pkt *IPPacket) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return false
+	}
+
+	raw := pkt.Raw
+	if q.layer2 {
+		raw = framePayload(raw)
+	}
+	band, bucket := classify(raw)
+	other := bandBulk
+	if band == bandBulk {
+		other = bandInteractive
+	}
+	if len(q.bands[other].flows[bucket].pkts) > 0 {
+		band = other // the flow's DSCP changed while it has packets queued
+	}
+	b := &q.bands[band]
+	f := &b.flows[bucket]
+	pkt.enqueued = time.Now()
+	f.pkts = append(f.pkts, pkt)
+	f.bytes += len(pkt.Raw)
+	if !f.active {
+		f.active = true
+		f.deficit = fqQuantum
+		b.newFlows = append(b.newFlows, f)
+	}
+	q.count++
+	q.stats.Enqueued++
+
+	if q.count > q.limit {
+		q.dropFattest()
+	}
+	q.cond.Signal()
+	return true
+}
+
+// dropFattest drops the head packet of the flow with the largest backlog.
+func (q *packetQueue) dropFattest() {
+	var fattest *codelFlow
+	for i := len(q.bands) - 1; i >= 0; i-- {
+		for j := range q.bands[i].flows {
+			if f := &q.bands[i].flows[j]; len(f.pkts) > 0 && (fattest == nil || f.bytes > fattest.bytes) {
+				fattest = f
+			}
+		}
+		if fattest != nil {
+			break // prefer dropping from lower-priority bands
+		}
+	}
+	fattest.pop()
+	q.count--
+	q.stats.Overlimit++
+}
+
+// Dequeue blocks until a packet is available, returning false once the queue
+// is closed. The packet is nil if the reader was woken by Wake.
+func (q *packetQueue) Dequeue() (*IPPacket, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		if q.closed {
+			return nil, false
+		}
+		if q.woken {
+			q.woken = false
+			return nil, true
+		}
+		// Past its rate, the interactive band is only dequeued when the bulk
+		// band is empty, and is not charged for it.
+		if q.interactive.available() {
+			if pkt := q.dequeueBand(&q.bands[bandInteractive]); pkt != nil {
+				q.interactive.spend(len(pkt.Raw))
+				return pkt, true
+			}
+		}
+		for i := len(q.bands) - 1; i >= 0; i-- {
+			if pkt := q.dequeueBand(&q.bands[i]); pkt != nil {
+				return pkt, true
+			}
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *packetQueue) dequeueBand(b *fqBand) *IPPacket {
+	for len(b.newFlows) > 0 || len(b.oldFlows) > 0 {
+		list := &b.newFlows
+		if len(b.newFlows) == 0 {
+			list = &b.oldFlows
+		}
+		f := (*list)[0]
+
+		if f.deficit <= 0 {
+			f.deficit += fqQuantum
+			*list = (*list)[1:]
+			b.oldFlows = append(b.oldFlows, f)
+			continue
+		}
+
+		pkt := q.codelDequeue(f, time.Now())
+		if pkt == nil {
+			*list = (*list)[1:]
+			if list == &b.newFlows && len(b.oldFlows) > 0 {
+				b.oldFlows = append(b.oldFlows, f)
+			} else {
+				f.active = false
+			}
+			continue
+		}
+		f.deficit -= len(pkt.Raw)
+		return pkt
+	}
+	return nil
+}
+
+// codelDequeue returns the next packet from f, dropping packets as needed
+// to keep the sojourn time near codelTarget.
+func (q *packetQueue) codelDequeue(f *codelFlow, now time.Time) *IPPacket {
+	pkt, okToDrop := q.codelPop(f, now)
+	if pkt == nil {
+		f.dropping = false
+		return nil
+	}
+
+	if f.dropping {
+		if !okToDrop {
+			f.dropping = false
+		}
+		for f.dropping && !now.Before(f.dropNext) {
+			q.stats.Dropped++
+			f.dropCount++
+			if pkt, okToDrop = q.codelPop(f, now); pkt == nil || !okToDrop {
+				f.dropping = false
+			} else {
+				f.dropNext = codelControlLaw(f.dropNext, f.dropCount)
+			}
+		}
+	} else if okToDrop {
+		q.stats.Dropped++
+		pkt, _ = q.codelPop(f, now)
+		f.dropping = true
+		delta := f.dropCount - f.lastCount
+		f.dropCount = 1
+		if delta > 1 && now.Sub(f.dropNext) < 16*codelInterval {
+			f.dropCount = delta
+		}
+		f.dropNext = codelControlLaw(now, f.dropCount)
+		f.lastCount = f.dropCount
+	}
+	return pkt
+}
+
+// codelPop removes the head packet of f, returning whether the packet has
+// been above the target sojourn time for at least an interval.
+func (q *packetQueue) codelPop(f *codelFlow, now time.Time) (*IPPacket, bool) {
+	pkt := f.pop()
+	if pkt == nil {
+		f.firstAboveTime = time.Time{}
+		return nil, false
+	}
+	q.count--
+
+	sojourn := now.Sub(pkt.enqueued)
+	q.recordDelay(sojourn)
+	if sojourn < codelTarget || f.bytes <= devMtuSize {
+		f.firstAboveTime = time.Time{}
+		return pkt, false
+	}
+	if f.firstAboveTime.IsZero() {
+		f.firstAboveTime = now.Add(codelInterval)
+		return pkt, false
+	}
+	return pkt, !now.Before(f.firstAboveTime)
+}
+
+func codelControlLaw(t time.Time, count int) time.Time {
+	return t.Add(time.Duration(float64(codelInterval) / math.Sqrt(float64(count))))
+}
+
+func (q *packetQueue) recordDelay(d time.Duration) {
+	// exponentially-weighted moving average, with a weight of 1/16.
+	q.stats.AvgDelay += (d - q.stats.AvgDelay) / 16
+	if d > q.stats.MaxDelay {
+		q.stats.MaxDelay = d
+	}
+}
+
+func (f *codelFlow) pop() *IPPacket {
+	if len(f.pkts) == 0 {
+		return nil
+	}
+	pkt := f.pkts[0]
+	f.pkts[0] = nil
+	f.pkts = f.pkts[1:]
+	f.bytes -= len(pkt.Raw)
+	return pkt
+}
+
+// Flush drops all queued packets.
+func (q *packetQueue) Flush() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i := range q.bands {
+		b := &q.bands[i]
+		for j := range b.flows {
+			b.flows[j] = codelFlow{}
+		}
+		b.newFlows, b.oldFlows = nil, nil
+	}
+	q.count = 0
+}
+
+// Wake causes the next (or a blocked) Dequeue to return a nil packet.
+func (q *packetQueue) Wake() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.woken = true
+	q.cond.Broadcast()
+}
+
+// Close wakes any blocked readers, and causes future operations to fail.
+func (q *packetQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Stats returns statistics about the packets which have passed through the queue.
+func (q *packetQueue) Stats() QueueStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	s := q.stats
+	s.Backlog = q.count
+	return s
+}
+
+// framePayload returns the payload of an ethernet frame, skipping any VLAN tag.
+func framePayload(frame []byte) []byte {
+	if len(frame) >= 18 && binary.BigEndian.Uint16(frame[12:14]) == 0x8100 {
+		return frame[18:]
+	}
+	if len(frame) >= 14 {
+		return frame[14:]
+	}
+	return frame
+}
+
+// classify returns the band and flow bucket for an IP packet.
+func classify(pkt []byte) (band int, bucket uint32) {
+	band = bandBulk
+	h := fnv.New32a()
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		if interactiveDSCP[pkt[1]>>2] {
+			band = bandInteractive
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		proto := pkt[9]
+		h.Write(pkt[12:20]) // source & destination address
+		h.Write([]byte{proto})
+		fragmented := binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0
+		if !fragmented && (proto == 6 || proto == 17) && len(pkt) >= ihl+4 {
+			h.Write(pkt[ihl : ihl+4]) // source & destination port
+		}
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		tc := pkt[0]<<4 | pkt[1]>>4
+		if interactiveDSCP[tc>>2] {
+			band = bandInteractive
+		}
+		next := pkt[6]
+		h.Write(pkt[8:40])
+		h.Write([]byte{next})
+		if (next == 6 || next == 17) && len(pkt) >= 44 {
+			h.Write(pkt[40:44])
+		}
+	default:
+		h.Write(pkt)
+	}
+	return band, h.Sum32() % fqFlowBuckets
+}
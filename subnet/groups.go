@@ -0,0 +1,51 @@
+package subnet
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// clientGroups describes which clients may communicate with each other when
+// clients are isolated. Clients sharing a group may communicate.
+type clientGroups struct {
+	memberOf map[string]map[string]bool // identity -> group names
+}
+
+// readGroups reads a JSON object mapping group names to the identities of
+// their members.
+func readGroups(path string) (*clientGroups, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var groups map[string][]string
+	if err := json.NewDecoder(f).Decode(&groups); err != nil {
+		return nil, err
+	}
+
+	g := &clientGroups{memberOf: map[string]map[string]bool{}}
+	for name, members := range groups {
+		for _, identity := range members {
+			if g.memberOf[identity] == nil {
+				g.memberOf[identity] = map[string]bool{}
+			}
+			g.memberOf[identity][name] = true
+		}
+	}
+	return g, nil
+}
+
+// share returns true if the clients with identities a & b are in a common group.
+func (g *clientGroups) share(a, b string) bool {
+	if g == nil {
+		return false
+	}
+	for name := range g.memberOf[a] {
+		if g.memberOf[b][name] {
+			return true
+		}
+	}
+	return false
+}
@@ -27,6 +27,11 @@ func SetDevIP(iName string, localAddr net.IP, addr *net.IPNet, debug bool) error
 	return commandExec("ipconfig", strings.Split(sargs, " "), debug)
 }
 
+// SetBridge adds interface iName to the bridge interface.
+func SetBridge(iName, bridge string, debug bool) error {
+	return commandExec("ifconfig", []string{bridge, "addm", iName}, debug)
+}
+
 // SetDefaultGateway sets the systems gateway to the IP / device specified.
 func SetDefaultGateway(gw, iName string, debug bool) error {
 	sargs := fmt.Sprintf("-n change default -interface %s", iName)
@@ -34,18 +39,45 @@ func SetDefaultGateway(gw, iName string, debug bool) error {
 	return commandExec("route", args, debug)
 }
 
-// AddRoute routes all traffic for addr via interface iName.
-func AddRoute(addr, viaAddr net.IP, iName string, debug bool) error {
-	sargs := fmt.Sprintf("-n add %s %s -ifscope %s", addr.String(), viaAddr.String(), iName)
-	args := strings.Split(sargs, " ")
-	return commandExec("route", args, debug)
+// AddRoute routes all traffic for dest via interface iName. If viaAddr is nil,
+// dest is routed directly on the interface.
+func AddRoute(dest *net.IPNet, viaAddr net.IP, iName string, debug bool) error {
+	return commandExec("route", routeArgs("add", dest, viaAddr, iName), debug)
 }
 
 // DelRoute deletes the route in the system routing table to a specific destination.
-func DelRoute(addr, viaAddr net.IP, iName string, debug bool) error {
-	sargs := fmt.Sprintf("-n delete %s %s -ifscope %s", addr.String(), viaAddr.String(), iName)
-	args := strings.Split(sargs, " ")
-	return commandExec("route", args, debug)
+func DelRoute(dest *net.IPNet, viaAddr net.IP, iName string, debug bool) error {
+	return commandExec("route", routeArgs("delete", dest, viaAddr, iName), debug)
+}
+
+// AddRouteInTable is only supported on linux.
+func AddRouteInTable(dest *net.IPNet, viaAddr net.IP, iName string, table int, debug bool) error {
+	return errRoutingTablesUnsupported
+}
+
+// DelRouteInTable is only supported on linux.
+func DelRouteInTable(dest *net.IPNet, viaAddr net.IP, iName string, table int, debug bool) error {
+	return errRoutingTablesUnsupported
+}
+
+// AddRule is only supported on linux.
+func AddRule(iif string, table int, ipv6 bool, debug bool) error {
+	return errRoutingTablesUnsupported
+}
+
+// DelRule is only supported on linux.
+func DelRule(iif string, table int, ipv6 bool, debug bool) error {
+	return errRoutingTablesUnsupported
+}
+
+var errRoutingTablesUnsupported = errors.New("routing tables are only supported on linux")
+
+func routeArgs(op string, dest *net.IPNet, viaAddr net.IP, iName string) []string {
+	args := []string{"-n", op, "-net", dest.String()}
+	if viaAddr == nil {
+		return append(args, "-interface", iName)
+	}
+	return append(args, viaAddr.String(), "-ifscope", iName)
 }
 
 var parseRouteGetRegex = regexp.MustCompile(`(?m)^\W*([^\:]+):\W(.*)$`)
@@ -72,3 +104,23 @@ func GetNetGateway() (gw, dev string, err error) {
 
 	return defaultRouteInfo["gateway"], defaultRouteInfo["interface"], nil
 }
+
+// SetSysctl sets a kernel parameter, such as "net.inet.ip.forwarding".
+func SetSysctl(key, value string) error {
+	return commandExec("sysctl", []string{"-w", key + "=" + value}, false)
+}
+
+// GetSysctl returns the current value of a kernel parameter.
+func GetSysctl(key string) (string, error) {
+	out, err := exec.Command("sysctl", "-n", key).Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// ForwardingSysctl returns the kernel parameter which enables forwarding of
+// packets in the address family of ip.
+func ForwardingSysctl(ip net.IP) string {
+	if ip.To4() != nil {
+		return "net.inet.ip.forwarding"
+	}
+	return "net.inet6.ip6.forwarding"
+}
@@ -1,105 +1,165 @@
 package subnet
 
 import (
-	"bufio"
-	"bytes"
-	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
-	"os"
-	"strconv"
 	"strings"
+	"syscall"
 )
 
 //SetInterfaceStatus brings up or down a network interface.
 func SetInterfaceStatus(iName string, up bool, debug bool) error {
-	statusString := "down"
-	if up {
-		statusString = "up"
+	if debug {
+		log.Printf("netlink: set %s up=%v mtu %d qlen %d\n", iName, up, devMtuSize, devTxQueLen)
 	}
-	sargs := fmt.Sprintf("link set dev %s %s mtu %d qlen %d", iName, statusString, devMtuSize, devTxQueLen)
-	args := strings.Split(sargs, " ")
-	return commandExec("ip", args, debug)
+	if err := netlinkSetLink(iName, up, devMtuSize, devTxQueLen); err != nil {
+		return fmt.Errorf("setting state of %s: %v", iName, err)
+	}
+	return nil
 }
 
 //SetDevIP sets the local IP address of a network interface.
 func SetDevIP(iName string, localAddr net.IP, addr *net.IPNet, debug bool) error {
-	sargs := fmt.Sprintf("%s %s netmask %s", iName, localAddr.String(), net.IP(addr.Mask).String())
-	args := strings.Split(sargs, " ")
-	return commandExec("ifconfig", args, debug)
+	if debug {
+		log.Printf("netlink: add address %s/%d to %s\n", localAddr, maskBits(addr.Mask), iName)
+	}
+	if err := netlinkAddAddr(iName, localAddr, addr.Mask); err != nil {
+		return fmt.Errorf("adding address %s/%d to %s: %v", localAddr, maskBits(addr.Mask), iName, err)
+	}
+	// Like ifconfig, bring the interface up once it has an address.
+	if err := netlinkSetLink(iName, true, 0, 0); err != nil {
+		return fmt.Errorf("bringing up %s: %v", iName, err)
+	}
+	return nil
+}
+
+// SetBridge adds interface iName to the bridge interface.
+func SetBridge(iName, bridge string, debug bool) error {
+	if debug {
+		log.Printf("netlink: set %s master %s\n", iName, bridge)
+	}
+	master, err := interfaceIndex(bridge)
+	if err != nil {
+		return fmt.Errorf("finding bridge %s: %v", bridge, err)
+	}
+	if err := netlinkSetMaster(iName, master); err != nil {
+		return fmt.Errorf("adding %s to bridge %s: %v", iName, bridge, err)
+	}
+	return nil
 }
 
 // SetDefaultGateway sets the systems gateway to the IP / device specified.
 func SetDefaultGateway(gw, iName string, debug bool) error {
-	sargs := fmt.Sprintf("add default gw %s dev %s", gw, iName)
-	args := strings.Split(sargs, " ")
-	return commandExec("route", args, debug)
+	gateway := net.ParseIP(gw)
+	if gateway == nil {
+		return fmt.Errorf("invalid gateway address %q", gw)
+	}
+	dest := &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+	if gateway.To4() == nil {
+		dest = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return AddRoute(dest, gateway, iName, debug)
 }
 
-// AddRoute routes all traffic for addr via interface iName.
-func AddRoute(addr, viaAddr net.IP, iName string, debug bool) error {
-	sargs := fmt.Sprintf("add %s gw %s dev %s", addr.String(), viaAddr.String(), iName)
-	args := strings.Split(sargs, " ")
-	return commandExec("route", args, debug)
+// AddRoute routes all traffic for dest via interface iName. If viaAddr is nil,
+// dest is routed directly on the interface.
+func AddRoute(dest *net.IPNet, viaAddr net.IP, iName string, debug bool) error {
+	return AddRouteInTable(dest, viaAddr, iName, syscall.RT_TABLE_MAIN, debug)
 }
 
 // DelRoute deletes the route in the system routing table to a specific destination.
-func DelRoute(addr, viaAddr net.IP, iName string, debug bool) error {
-	sargs := fmt.Sprintf("del %s gw %s dev %s", addr.String(), viaAddr.String(), iName)
-	args := strings.Split(sargs, " ")
-	return commandExec("route", args, debug)
+func DelRoute(dest *net.IPNet, viaAddr net.IP, iName string, debug bool) error {
+	return DelRouteInTable(dest, viaAddr, iName, syscall.RT_TABLE_MAIN, debug)
 }
 
-// GetNetGateway return net gateway (default route) and nic.
-// Credit: https://github.com/bigeagle/gohop/blob/master/hop/iface.go
-func GetNetGateway() (gw, dev string, err error) {
-	file, err := os.Open("/proc/net/route")
-	if err != nil {
-		return "", "", err
+// AddRouteInTable is like AddRoute, but adds the route to the given routing table.
+func AddRouteInTable(dest *net.IPNet, viaAddr net.IP, iName string, table int, debug bool) error {
+	if debug {
+		log.Printf("netlink: add route %s via %v dev %s table %d\n", dest, viaAddr, iName, table)
 	}
+	if err := netlinkRoute(syscall.RTM_NEWROUTE, dest, viaAddr, iName, table); err != nil {
+		return fmt.Errorf("adding route to %s via %v on %s (table %d): %v", dest, viaAddr, iName, table, err)
+	}
+	return nil
+}
 
-	defer file.Close()
-	rd := bufio.NewReader(file)
-
-	s2byte := func(s string) byte {
-		b, _ := strconv.ParseUint(s, 16, 8)
-		return byte(b)
+// DelRouteInTable is like DelRoute, but deletes the route from the given routing table.
+func DelRouteInTable(dest *net.IPNet, viaAddr net.IP, iName string, table int, debug bool) error {
+	if debug {
+		log.Printf("netlink: delete route %s via %v dev %s table %d\n", dest, viaAddr, iName, table)
+	}
+	if err := netlinkRoute(syscall.RTM_DELROUTE, dest, viaAddr, iName, table); err != nil {
+		return fmt.Errorf("deleting route to %s via %v on %s (table %d): %v", dest, viaAddr, iName, table, err)
 	}
+	return nil
+}
 
-	for {
-		line, isPrefix, err := rd.ReadLine()
+// AddRule routes IPv4 (or IPv6) traffic arriving on interface iif using the
+// given routing table.
+func AddRule(iif string, table int, ipv6 bool, debug bool) error {
+	if debug {
+		log.Printf("netlink: add rule iif %s lookup %d\n", iif, table)
+	}
+	if err := netlinkRule(syscall.RTM_NEWRULE, ruleFamily(ipv6), iif, table); err != nil {
+		return fmt.Errorf("adding rule for %s to table %d: %v", iif, table, err)
+	}
+	return nil
+}
 
-		if err != nil {
-			return "", "", err
-		}
-		if isPrefix {
-			return "", "", errors.New("Parse error: Line too long")
-		}
-		buf := bytes.NewBuffer(line)
-		scanner := bufio.NewScanner(buf)
-		scanner.Split(bufio.ScanWords)
-		tokens := make([]string, 0, 8)
+// DelRule deletes a rule added by AddRule.
+func DelRule(iif string, table int, ipv6 bool, debug bool) error {
+	if debug {
+		log.Printf("netlink: delete rule iif %s lookup %d\n", iif, table)
+	}
+	if err := netlinkRule(syscall.RTM_DELRULE, ruleFamily(ipv6), iif, table); err != nil {
+		return fmt.Errorf("deleting rule for %s to table %d: %v", iif, table, err)
+	}
+	return nil
+}
 
-		for scanner.Scan() {
-			tokens = append(tokens, scanner.Text())
-		}
+func ruleFamily(ipv6 bool) uint8 {
+	if ipv6 {
+		return syscall.AF_INET6
+	}
+	return syscall.AF_INET
+}
 
-		iface := tokens[0]
-		dest := tokens[1]
-		gw := tokens[2]
-		mask := tokens[7]
+// GetNetGateway return net gateway (default route) and nic.
+func GetNetGateway() (gw, dev string, err error) {
+	gateway, dev, err := netlinkDefaultRoute(syscall.AF_INET)
+	if err != nil {
+		return "", "", fmt.Errorf("reading default route: %v", err)
+	}
+	return gateway.String(), dev, nil
+}
 
-		if bytes.Equal([]byte(dest), []byte("00000000")) &&
-			bytes.Equal([]byte(mask), []byte("00000000")) {
-			a := s2byte(gw[6:8])
-			b := s2byte(gw[4:6])
-			c := s2byte(gw[2:4])
-			d := s2byte(gw[0:2])
+func maskBits(mask net.IPMask) int {
+	ones, _ := mask.Size()
+	return ones
+}
 
-			ip := net.IPv4(a, b, c, d)
+// SetSysctl sets a kernel parameter, such as "net.ipv4.ip_forward".
+func SetSysctl(key, value string) error {
+	return ioutil.WriteFile(sysctlPath(key), []byte(value+"\n"), 0644)
+}
 
-			return ip.String(), iface, nil
-		}
+// GetSysctl returns the current value of a kernel parameter.
+func GetSysctl(key string) (string, error) {
+	d, err := ioutil.ReadFile(sysctlPath(key))
+	return strings.TrimSpace(string(d)), err
+}
 
+// ForwardingSysctl returns the kernel parameter which enables forwarding of
+// packets in the address family of ip.
+func ForwardingSysctl(ip net.IP) string {
+	if ip.To4() != nil {
+		return "net.ipv4.ip_forward"
 	}
+	return "net.ipv6.conf.all.forwarding"
+}
+
+func sysctlPath(key string) string {
+	return "/proc/sys/" + strings.Replace(key, ".", "/", -1)
 }
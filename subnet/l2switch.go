@@ -0,0 +1,77 @@
+package subnet
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// devPort identifies the server's TUN/TAP device as the source or
+	// destination of a packet, in place of a client ID.
+	devPort = -1
+	// switchNoPort indicates a frame should be dropped.
+	switchNoPort = -2
+	// switchMACAge is how long a learned MAC address is remembered without
+	// seeing further frames from it.
+	switchMACAge = 5 * time.Minute
+)
+
+type macEntry struct {
+	port     int
+	lastSeen time.Time
+}
+
+// l2Switch forwards ethernet frames between ports (clients, and the server's
+// TAP device), learning which port each MAC address is reachable through.
+// Broadcast, multicast & frames to unknown addresses are flooded.
+type l2Switch struct {
+	lock  sync.Mutex
+	table map[[6]byte]macEntry
+}
+
+func newL2Switch() *l2Switch {
+	return &l2Switch{table: map[[6]byte]macEntry{}}
+}
+
+// forward learns the source address of frame, and returns the port it should
+// be sent to, or flood=true if it should be sent to all ports except srcPort.
+// If the frame should not be sent anywhere, switchNoPort is returned.
+func (s *l2Switch) forward(frame []byte, srcPort int) (port int, flood bool) {
+	if len(frame) < 14 {
+		return switchNoPort, false
+	}
+	var dst, src [6]byte
+	copy(dst[:], frame[0:6])
+	copy(src[:], frame[6:12])
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if src[0]&1 == 0 { // never learn group addresses
+		s.table[src] = macEntry{port: srcPort, lastSeen: now}
+	}
+
+	if dst[0]&1 != 0 { // broadcast or multicast
+		return switchNoPort, true
+	}
+	e, ok := s.table[dst]
+	if !ok || now.Sub(e.lastSeen) > switchMACAge {
+		delete(s.table, dst)
+		return switchNoPort, true
+	}
+	if e.port == srcPort {
+		return switchNoPort, false // destination is on the segment it came from
+	}
+	return e.port, false
+}
+
+// forget removes all addresses learned on port.
+func (s *l2Switch) forget(port int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for mac, e := range s.table {
+		if e.port == port {
+			delete(s.table, mac)
+		}
+	}
+}
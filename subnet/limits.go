@@ -0,0 +1,247 @@
+package subnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// clientLimit describes the bandwidth limits and data quota applied to a client.
+// Rates are in bytes per second, and a zero value means unlimited.
+type clientLimit struct {
+	IngressRate int64 `json:"ingress_bps"`
+	EgressRate  int64 `json:"egress_bps"`
+	Burst       int64 `json:"burst_bytes"`
+
+	Quota       int64  `json:"quota_bytes"`
+	QuotaPeriod string `json:"quota_period"` // "daily" or "monthly"
+	// OverQuota is either "throttle" or "disconnect". Throttled clients are
+	// limited to ThrottleRate in both directions.
+	OverQuota    string `json:"over_quota"`
+	ThrottleRate int64  `json:"throttle_bps"`
+}
+
+// clientLimits maps client identities to their limits. The entry with the
+// identity "*" applies to clients without an entry of their own.
+type clientLimits map[string]*clientLimit
+
+func readLimits(path string) (clientLimits, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var limits clientLimits
+	if err := json.NewDecoder(f).Decode(&limits); err != nil {
+		return nil, err
+	}
+	for identity, l := range limits {
+		if l == nil {
+			return nil, fmt.Errorf("%q: limits must be an object", identity)
+		}
+		if l.Quota <= 0 {
+			continue
+		}
+		if l.QuotaPeriod != "daily" && l.QuotaPeriod != "monthly" {
+			return nil, fmt.Errorf("%q: quota_period must be daily or monthly", identity)
+		}
+		switch l.OverQuota {
+		case "throttle":
+			// A zero rate would mean unlimited, rather than blocked.
+			if l.ThrottleRate <= 0 {
+				return nil, fmt.Errorf("%q: throttle_bps must be positive when over_quota is throttle", identity)
+			}
+		case "disconnect":
+		default:
+			return nil, fmt.Errorf("%q: over_quota must be throttle or disconnect", identity)
+		}
+	}
+	return limits, nil
+}
+
+func (l clientLimits) forIdentity(identity string) *clientLimit {
+	if limit, ok := l[identity]; ok {
+		return limit
+	}
+	return l["*"]
+}
+
+// tokenBucket rate-limits a stream of bytes, allowing bursts of up to burst bytes.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int64) *tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// setRate changes the rate at which tokens are replenished.
+func (b *tokenBucket) setRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.rate = float64(rate)
+}
+
+// available returns true if any tokens are left.
+func (b *tokenBucket) available() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	return b.tokens > 0
+}
+
+// spend consumes the tokens of n bytes, which may leave the bucket in debt.
+func (b *tokenBucket) spend(n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	b.tokens -= float64(n)
+}
+
+// refill adds the tokens accrued since it was last called. Must be called
+// with lock held.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// wait blocks until n bytes may be sent.
+func (b *tokenBucket) wait(n int) {
+	b.lock.Lock()
+	if b.rate <= 0 {
+		b.lock.Unlock()
+		return
+	}
+	b.refill()
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.lock.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+type quotaUsage struct {
+	Period string `json:"period"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// quotaStore tracks data usage against quotas, persisting it to disk.
+type quotaStore struct {
+	path  string
+	lock  sync.Mutex
+	usage map[string]*quotaUsage
+	dirty bool
+}
+
+func newQuotaStore(path string) (*quotaStore, error) {
+	q := &quotaStore{path: path, usage: map[string]*quotaUsage{}}
+	if path == "" {
+		return q, nil
+	}
+
+	d, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(d, &q.usage); err != nil {
+			return nil, err
+		}
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			if err := q.save(); err != nil {
+				log.Printf("Failed to save quota state: %s\n", err)
+			}
+		}
+	}()
+	return q, nil
+}
+
+func quotaPeriod(period string, t time.Time) string {
+	if period == "daily" {
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01")
+}
+
+// add records n bytes against the quota of identity, returning true if the
+// quota has been exceeded.
+func (q *quotaStore) add(identity string, limit *clientLimit, n int) bool {
+	if limit == nil || limit.Quota <= 0 {
+		return false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	period := quotaPeriod(limit.QuotaPeriod, time.Now())
+	u, ok := q.usage[identity]
+	if !ok || u.Period != period {
+		u = &quotaUsage{Period: period}
+		q.usage[identity] = u
+	}
+	u.Bytes += int64(n)
+	q.dirty = true
+	return u.Bytes > limit.Quota
+}
+
+// exceeded returns true if identity has used its quota for the current period.
+func (q *quotaStore) exceeded(identity string, limit *clientLimit) bool {
+	if limit == nil || limit.Quota <= 0 {
+		return false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	u, ok := q.usage[identity]
+	return ok && u.Period == quotaPeriod(limit.QuotaPeriod, time.Now()) && u.Bytes > limit.Quota
+}
+
+func (q *quotaStore) save() error {
+	if q.path == "" {
+		return nil
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.dirty {
+		return nil
+	}
+
+	d, err := json.MarshalIndent(q.usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(q.path, d, 0644); err != nil {
+		return err
+	}
+	q.dirty = false
+	return nil
+}
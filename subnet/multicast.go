@@ -0,0 +1,260 @@
+package subnet
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Multicast forwarding modes.
+const (
+	MulticastFlood = "flood" // replicate to all clients
+	MulticastSnoop = "snoop" // replicate to clients subscribed via IGMP
+)
+
+const (
+	igmpProtocol        = 2
+	igmpQueryInterval   = 125 * time.Second
+	igmpMembershipAge   = 2*igmpQueryInterval + 10*time.Second
+	igmpMaxResponseTime = 100 // tenths of a second
+)
+
+var (
+	allHostsGroup   = net.IPv4(224, 0, 0, 1).To4()
+	linkLocalGroups = &net.IPNet{IP: net.IPv4(224, 0, 0, 0).To4(), Mask: net.CIDRMask(24, 32)}
+)
+
+// multicastRouter decides which clients multicast & broadcast packets within
+// the VPN are replicated to. In snoop mode, IGMP reports from clients are
+// tracked to learn which groups each client is subscribed to.
+type multicastRouter struct {
+	mode      string
+	allow     []*net.IPNet // groups which may be forwarded, or nil for all
+	broadcast net.IP       // broadcast address of the VPN network
+
+	// clientAllow, if set, lists the multicast groups each client, or the
+	// members of each client group, may send & receive (see ReadMulticastAllow).
+	clientAllow map[string][]*net.IPNet
+	groups      *clientGroups
+
+	lock    sync.Mutex
+	members map[string]map[int]time.Time // group -> client ID -> expiry
+}
+
+// ReadMulticastAllow reads a JSON object mapping the names of clients, or of
+// client groups (see ServerOptions.GroupsPath), to the multicast groups (CIDR)
+// their members may send & receive. The entry "*" applies to clients which are
+// not listed, and in no listed group.
+func ReadMulticastAllow(path string) (map[string][]*net.IPNet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lists map[string][]string
+	if err := json.NewDecoder(f).Decode(&lists); err != nil {
+		return nil, err
+	}
+	out := map[string][]*net.IPNet{}
+	for name, nets := range lists {
+		out[name] = []*net.IPNet{}
+		for _, n := range nets {
+			_, ipNet, err := net.ParseCIDR(n)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %v", name, err)
+			}
+			out[name] = append(out[name], ipNet)
+		}
+	}
+	return out, nil
+}
+
+func newMulticastRouter(mode string, allow []*net.IPNet, network *net.IPNet) *multicastRouter {
+	var broadcast net.IP
+	if ip4 := network.IP.To4(); ip4 != nil && len(network.Mask) == net.IPv4len {
+		broadcast = make(net.IP, net.IPv4len)
+		for i := range ip4 {
+			broadcast[i] = ip4[i] | ^network.Mask[i]
+		}
+	}
+	return &multicastRouter{
+		mode:      mode,
+		allow:     allow,
+		broadcast: broadcast,
+		members:   map[string]map[int]time.Time{},
+	}
+}
+
+// isBroadcast returns true if dest is the limited or subnet-directed broadcast address.
+func (m *multicastRouter) isBroadcast(dest net.IP) bool {
+	return dest.Equal(net.IPv4bcast) || (m.broadcast != nil && dest.Equal(m.broadcast))
+}
+
+// allowed returns true if packets to group may be forwarded.
+func (m *multicastRouter) allowed(group net.IP) bool {
+	if m.allow == nil || m.isBroadcast(group) {
+		return true
+	}
+	for _, n := range m.allow {
+		if n.Contains(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedFor returns true if the client with identity may send or receive
+// packets to group, according to its own allow list, or else those of its
+// client groups.
+func (m *multicastRouter) allowedFor(group net.IP, identity string) bool {
+	if m.clientAllow == nil || m.isBroadcast(group) {
+		return true
+	}
+	if nets, ok := m.clientAllow[identity]; ok {
+		return containsIP(nets, group)
+	}
+	var listed bool
+	if m.groups != nil {
+		for name := range m.groups.memberOf[identity] {
+			nets, ok := m.clientAllow[name]
+			listed = listed || ok
+			if containsIP(nets, group) {
+				return true
+			}
+		}
+	}
+	return !listed && containsIP(m.clientAllow["*"], group)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// wants returns true if a packet to dest should be sent to the client.
+func (m *multicastRouter) wants(dest net.IP, client int) bool {
+	// Link-local groups are always flooded, as hosts need not report them (RFC 4541).
+	if m.mode == MulticastFlood || m.isBroadcast(dest) || linkLocalGroups.Contains(dest) {
+		return true
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	expiry, ok := m.members[dest.String()][client]
+	return ok && time.Now().Before(expiry)
+}
+
+// snoop updates group membership from an IGMP packet sent by client.
+func (m *multicastRouter) snoop(pkt []byte, client int) {
+	if len(pkt) < 20 {
+		return
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	if len(pkt) < ihl+8 {
+		return
+	}
+	igmp := pkt[ihl:]
+
+	switch igmp[0] {
+	case 0x12, 0x16: // v1 & v2 membership reports
+		m.join(net.IP(igmp[4:8]), client)
+	case 0x17: // v2 leave
+		m.leave(net.IP(igmp[4:8]), client)
+	case 0x22: // v3 membership report
+		numRecords := int(binary.BigEndian.Uint16(igmp[6:8]))
+		off := 8
+		for i := 0; i < numRecords && off+8 <= len(igmp); i++ {
+			recordType, auxLen := igmp[off], int(igmp[off+1])
+			numSources := int(binary.BigEndian.Uint16(igmp[off+2 : off+4]))
+			group := net.IP(igmp[off+4 : off+8])
+			switch {
+			case recordType == 2 || recordType == 4 || recordType == 5: // EXCLUDE, TO_EXCLUDE, ALLOW
+				m.join(group, client)
+			case (recordType == 1 || recordType == 3) && numSources == 0: // INCLUDE {}, i.e. leave
+				m.leave(group, client)
+			case recordType == 1 || recordType == 3:
+				m.join(group, client)
+			}
+			off += 8 + 4*numSources + 4*auxLen
+		}
+	}
+}
+
+func (m *multicastRouter) join(group net.IP, client int) {
+	if !group.IsMulticast() {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	g := group.String()
+	if m.members[g] == nil {
+		m.members[g] = map[int]time.Time{}
+	}
+	m.members[g][client] = time.Now().Add(igmpMembershipAge)
+}
+
+func (m *multicastRouter) leave(group net.IP, client int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	g := group.String()
+	delete(m.members[g], client)
+	if len(m.members[g]) == 0 {
+		delete(m.members, g)
+	}
+}
+
+// forget removes all memberships of a client.
+func (m *multicastRouter) forget(client int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for g, clients := range m.members {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(m.members, g)
+		}
+	}
+}
+
+// igmpQuery returns an IGMPv2 general query from src, which prompts hosts to
+// report the groups they are subscribed to.
+func igmpQuery(src net.IP) *IPPacket {
+	pkt := make([]byte, 32)
+	pkt[0] = 0x46 // IPv4, 24 byte header (with router alert option)
+	pkt[1] = 0xc0 // DSCP CS6
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 1 // TTL
+	pkt[9] = igmpProtocol
+	copy(pkt[12:16], src.To4())
+	copy(pkt[16:20], allHostsGroup)
+	copy(pkt[20:24], []byte{0x94, 0x04, 0, 0}) // router alert
+	binary.BigEndian.PutUint16(pkt[10:12], inetChecksum(pkt[:24]))
+
+	igmp := pkt[24:]
+	igmp[0] = 0x11 // membership query
+	igmp[1] = igmpMaxResponseTime
+	binary.BigEndian.PutUint16(igmp[2:4], inetChecksum(igmp))
+	return &IPPacket{Raw: pkt, Dest: allHostsGroup, Protocol: igmpProtocol}
+}
+
+// inetChecksum computes the internet checksum (RFC 1071) of b.
+func inetChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
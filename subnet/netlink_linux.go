@@ -0,0 +1,315 @@
+package subnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// Constants from linux/fib_rules.h.
+const (
+	frActToTbl = 1
+	fraIIFName = 3
+	fraTable   = 15
+)
+
+var netlinkSeq uint32
+
+// netlinkRequest is a rtnetlink message under construction.
+type netlinkRequest struct {
+	typ   uint16
+	flags uint16
+	data  []byte
+}
+
+func newNetlinkRequest(typ, flags uint16, header []byte) *netlinkRequest {
+	return &netlinkRequest{
+		typ:   typ,
+		flags: syscall.NLM_F_REQUEST | flags,
+		data:  header,
+	}
+}
+
+// addAttr appends a route attribute to the request.
+func (r *netlinkRequest) addAttr(typ uint16, value []byte) {
+	l := syscall.SizeofRtAttr + len(value)
+	attr := make([]byte, rtaAlign(l))
+	binary.NativeEndian.PutUint16(attr[0:2], uint16(l))
+	binary.NativeEndian.PutUint16(attr[2:4], typ)
+	copy(attr[syscall.SizeofRtAttr:], value)
+	r.data = append(r.data, attr...)
+}
+
+func (r *netlinkRequest) addUint32Attr(typ uint16, value uint32) {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, value)
+	r.addAttr(typ, b)
+}
+
+func rtaAlign(l int) int {
+	return (l + syscall.RTA_ALIGNTO - 1) & ^(syscall.RTA_ALIGNTO - 1)
+}
+
+// execute sends the request to the kernel, returning any messages sent in
+// response. Errors reported by the kernel are returned as a syscall.Errno.
+func (r *netlinkRequest) execute() ([]syscall.NetlinkMessage, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	seq := atomic.AddUint32(&netlinkSeq, 1)
+	msg := make([]byte, syscall.NLMSG_HDRLEN+len(r.data))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:6], r.typ)
+	binary.NativeEndian.PutUint16(msg[6:8], r.flags)
+	binary.NativeEndian.PutUint32(msg[8:12], seq)
+	copy(msg[syscall.NLMSG_HDRLEN:], r.data)
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var out []syscall.NetlinkMessage
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return out, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, errors.New("netlink: truncated error message")
+				}
+				if errno := -int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(errno)
+				}
+				return out, nil // ACK
+			default:
+				out = append(out, m)
+			}
+		}
+	}
+}
+
+func ifInfoMsg(family uint8, index int, flags, change uint32) []byte {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	b[0] = family
+	binary.NativeEndian.PutUint32(b[4:8], uint32(int32(index)))
+	binary.NativeEndian.PutUint32(b[8:12], flags)
+	binary.NativeEndian.PutUint32(b[12:16], change)
+	return b
+}
+
+func ifAddrMsg(family uint8, prefixLen int, index int) []byte {
+	b := make([]byte, syscall.SizeofIfAddrmsg)
+	b[0] = family
+	b[1] = uint8(prefixLen)
+	binary.NativeEndian.PutUint32(b[4:8], uint32(index))
+	return b
+}
+
+func rtMsg(family uint8, dstLen int, table int, scope, typ uint8) []byte {
+	b := make([]byte, syscall.SizeofRtMsg)
+	b[0] = family
+	b[1] = uint8(dstLen)
+	if table < 256 {
+		b[4] = uint8(table)
+	} else {
+		b[4] = syscall.RT_TABLE_UNSPEC
+	}
+	b[5] = syscall.RTPROT_BOOT
+	b[6] = scope
+	b[7] = typ
+	return b
+}
+
+// ipFamily returns the address family & canonical byte representation of ip.
+func ipFamily(ip net.IP) (uint8, []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return syscall.AF_INET, ip4
+	}
+	return syscall.AF_INET6, ip.To16()
+}
+
+func interfaceIndex(iName string) (int, error) {
+	intf, err := net.InterfaceByName(iName)
+	if err != nil {
+		return 0, err
+	}
+	return intf.Index, nil
+}
+
+// netlinkSetLink sets the state, MTU & transmit queue length of an interface.
+// The MTU & queue length are left unchanged if zero.
+func netlinkSetLink(iName string, up bool, mtu, txQueueLen int) error {
+	index, err := interfaceIndex(iName)
+	if err != nil {
+		return err
+	}
+	var flags uint32
+	if up {
+		flags = syscall.IFF_UP
+	}
+	req := newNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_ACK, ifInfoMsg(syscall.AF_UNSPEC, index, flags, syscall.IFF_UP))
+	if mtu > 0 {
+		req.addUint32Attr(syscall.IFLA_MTU, uint32(mtu))
+	}
+	if txQueueLen > 0 {
+		req.addUint32Attr(syscall.IFLA_TXQLEN, uint32(txQueueLen))
+	}
+	_, err = req.execute()
+	return err
+}
+
+// netlinkSetMaster makes an interface a port of the master interface, such as a bridge.
+func netlinkSetMaster(iName string, masterIndex int) error {
+	index, err := interfaceIndex(iName)
+	if err != nil {
+		return err
+	}
+	req := newNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_ACK, ifInfoMsg(syscall.AF_UNSPEC, index, 0, 0))
+	req.addUint32Attr(syscall.IFLA_MASTER, uint32(masterIndex))
+	_, err = req.execute()
+	return err
+}
+
+// netlinkAddAddr assigns addr (with the prefix length of mask) to an interface.
+func netlinkAddAddr(iName string, addr net.IP, mask net.IPMask) error {
+	index, err := interfaceIndex(iName)
+	if err != nil {
+		return err
+	}
+	family, ip := ipFamily(addr)
+	prefixLen, _ := mask.Size()
+	req := newNetlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_ACK|syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, ifAddrMsg(family, prefixLen, index))
+	req.addAttr(syscall.IFA_LOCAL, ip)
+	req.addAttr(syscall.IFA_ADDRESS, ip)
+	if family == syscall.AF_INET && prefixLen < 31 {
+		brd := make(net.IP, len(ip))
+		for i := range ip {
+			brd[i] = ip[i] | ^mask[len(mask)-len(ip)+i]
+		}
+		req.addAttr(syscall.IFA_BROADCAST, brd)
+	}
+	_, err = req.execute()
+	return err
+}
+
+// netlinkRoute adds (RTM_NEWROUTE) or deletes (RTM_DELROUTE) a route in the
+// given routing table. If via is nil, the route is directly connected to iName.
+func netlinkRoute(op uint16, dest *net.IPNet, via net.IP, iName string, table int) error {
+	index, err := interfaceIndex(iName)
+	if err != nil {
+		return err
+	}
+	family, dst := ipFamily(dest.IP)
+	dstLen, _ := dest.Mask.Size()
+
+	scope := uint8(syscall.RT_SCOPE_UNIVERSE)
+	if via == nil {
+		scope = syscall.RT_SCOPE_LINK
+	}
+	flags := uint16(syscall.NLM_F_ACK)
+	if op == syscall.RTM_NEWROUTE {
+		flags |= syscall.NLM_F_CREATE | syscall.NLM_F_EXCL
+	}
+
+	req := newNetlinkRequest(op, flags, rtMsg(family, dstLen, table, scope, syscall.RTN_UNICAST))
+	if dstLen > 0 {
+		req.addAttr(syscall.RTA_DST, dst)
+	}
+	if via != nil {
+		viaFamily, gw := ipFamily(via)
+		if viaFamily != family {
+			return fmt.Errorf("gateway %s is not in the same address family as %s", via, dest)
+		}
+		req.addAttr(syscall.RTA_GATEWAY, gw)
+	}
+	req.addUint32Attr(syscall.RTA_OIF, uint32(index))
+	if table >= 256 {
+		req.addUint32Attr(syscall.RTA_TABLE, uint32(table))
+	}
+	_, err = req.execute()
+	return err
+}
+
+// netlinkRule adds (RTM_NEWRULE) or deletes (RTM_DELRULE) a policy routing rule
+// which looks up traffic arriving on iif in the given routing table.
+func netlinkRule(op uint16, family uint8, iif string, table int) error {
+	hdr := make([]byte, syscall.SizeofRtMsg) // struct fib_rule_hdr
+	hdr[0] = family
+	if table < 256 {
+		hdr[4] = uint8(table)
+	}
+	hdr[7] = frActToTbl
+
+	flags := uint16(syscall.NLM_F_ACK)
+	if op == syscall.RTM_NEWRULE {
+		flags |= syscall.NLM_F_CREATE | syscall.NLM_F_EXCL
+	}
+	req := newNetlinkRequest(op, flags, hdr)
+	req.addAttr(fraIIFName, append([]byte(iif), 0))
+	req.addUint32Attr(fraTable, uint32(table))
+	_, err := req.execute()
+	return err
+}
+
+// netlinkDefaultRoute returns the gateway & interface of the default route
+// in the main routing table for the given address family.
+func netlinkDefaultRoute(family uint8) (net.IP, string, error) {
+	req := newNetlinkRequest(syscall.RTM_GETROUTE, syscall.NLM_F_DUMP, rtMsg(family, 0, syscall.RT_TABLE_UNSPEC, 0, 0))
+	msgs, err := req.execute()
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		if m.Data[1] != 0 || m.Data[4] != syscall.RT_TABLE_MAIN { // dst_len, table
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return nil, "", err
+		}
+		var gw net.IP
+		var oif int
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.RTA_GATEWAY:
+				gw = net.IP(a.Value)
+			case syscall.RTA_OIF:
+				oif = int(binary.NativeEndian.Uint32(a.Value))
+			}
+		}
+		if gw == nil || oif == 0 {
+			continue
+		}
+		intf, err := net.InterfaceByIndex(oif)
+		if err != nil {
+			return nil, "", err
+		}
+		return gw, intf.Name, nil
+	}
+	return nil, "", errors.New("no default route")
+}
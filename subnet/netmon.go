@@ -0,0 +1,36 @@
+package subnet
+
+import (
+	"log"
+	"syscall"
+)
+
+// readChanges reads notifications from a routing socket, signalling changed
+// for each, until shutdown.
+func readChanges(fd int, changed chan<- struct{}, isShuttingDown *bool) {
+	defer syscall.Close(fd)
+	// Wake up periodically to check for shutdown.
+	tv := syscall.Timeval{Sec: 1}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		log.Printf("Could not watch for network changes: %s\n", err.Error())
+		return
+	}
+
+	buf := make([]byte, 8192)
+	for !*isShuttingDown {
+		if _, err := syscall.Read(fd, buf); err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			// ENOBUFS means notifications were dropped, so something changed.
+			if err != syscall.ENOBUFS {
+				log.Printf("Could not watch for network changes: %s\n", err.Error())
+				return
+			}
+		}
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
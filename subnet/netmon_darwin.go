@@ -0,0 +1,16 @@
+package subnet
+
+import (
+	"syscall"
+)
+
+// watchNetwork notifies changed (without blocking) whenever a link, address
+// or route changes, until shutdown.
+func watchNetwork(changed chan<- struct{}, isShuttingDown *bool) error {
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, syscall.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+	go readChanges(fd, changed, isShuttingDown)
+	return nil
+}
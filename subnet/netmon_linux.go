@@ -0,0 +1,30 @@
+package subnet
+
+import (
+	"syscall"
+)
+
+// Multicast groups from linux/rtnetlink.h, missing from syscall.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6IfAddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// watchNetwork notifies changed (without blocking) whenever a link, address
+// or route changes, until shutdown.
+func watchNetwork(changed chan<- struct{}, isShuttingDown *bool) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	groups := uint32(rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv4Route | rtmgrpIPv6IfAddr | rtmgrpIPv6Route)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	go readChanges(fd, changed, isShuttingDown)
+	return nil
+}
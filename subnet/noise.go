@@ -0,0 +1,83 @@
+package subnet
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/twitchyliquid64/subnet/subnet/conn"
+)
+
+// NoisePeer is a client which may connect with a Noise handshake (see
+// conn.NoiseTransport), identified by its public key.
+type NoisePeer struct {
+	PublicKey string `json:"public_key"`
+	// Addresses, if set, are the only addresses the client may use.
+	Addresses []string `json:"addresses,omitempty"`
+
+	key   *ecdh.PublicKey
+	addrs []net.IP
+}
+
+// ReadNoisePeers reads a JSON object mapping client names to their keys &
+// addresses. The name is the client's identity, as used by limits & groups.
+func ReadNoisePeers(path string) (map[string]*NoisePeer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var peers map[string]*NoisePeer
+	if err := json.NewDecoder(f).Decode(&peers); err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	for name, p := range peers {
+		if p == nil {
+			return nil, fmt.Errorf("peer %q: no public_key", name)
+		}
+		if p.key, err = conn.ParseNoisePublicKey(p.PublicKey); err != nil {
+			return nil, fmt.Errorf("peer %q: %v", name, err)
+		}
+		if keys[string(p.key.Bytes())] {
+			return nil, fmt.Errorf("peer %q: duplicate public_key", name)
+		}
+		keys[string(p.key.Bytes())] = true
+		for _, a := range p.Addresses {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("peer %q: invalid address %q", name, a)
+			}
+			p.addrs = append(p.addrs, ip)
+		}
+	}
+	return peers, nil
+}
+
+// authorizeNoisePeer returns the name of the peer with key.
+func (s *Server) authorizeNoisePeer(key *ecdh.PublicKey) (string, bool) {
+	for name, p := range s.noisePeers {
+		if bytes.Equal(p.key.Bytes(), key.Bytes()) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// addrPermitted returns true if the client with identity may use addr.
+func (s *Server) addrPermitted(identity string, addr net.IP) bool {
+	p := s.noisePeers[identity]
+	if p == nil || len(p.addrs) == 0 {
+		return true
+	}
+	for _, a := range p.addrs {
+		if a.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,59 +1,423 @@
 package subnet
 
 import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"log"
 	"net"
-
-	"github.com/songgao/water"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 )
 
+// DefaultJournalDir is the directory in which the reverser journals are
+// stored if no other path is specified.
+const DefaultJournalDir = "/var/lib/subnet"
+
+// ErrJournalInUse is returned by LockJournal if another process holds the lock.
+var ErrJournalInUse = errors.New("journal is in use by another subnet process")
+
 // Reverser contains a sequence of functions that need to be called on exit -
 // to unwind changes made to global configuration.
+//
+// If a journal path is set, the changes are persisted to disk before they
+// are made, so they can be undone by RestoreJournal() should the process
+// exit without calling Close().
 type Reverser struct {
-	RouteDeletions []routeEntries
+	JournalPath string
+
+	lock    sync.Mutex
+	entries []journalEntry
+}
+
+// journalEntry describes a change to system configuration, and how to undo it.
+type journalEntry struct {
+	Kind string `json:"kind"`
+
+	// kind == "route", "rule" or "nat"
+	Dest string `json:"dest,omitempty"`
+	Via  string `json:"via,omitempty"`
+	Dev  string `json:"dev,omitempty"`
+	// kind == "route" or "rule": the routing table, if not main
+	Table int  `json:"table,omitempty"`
+	IPv6  bool `json:"ipv6,omitempty"`
 
-	updateGateway bool
-	newGW         string
+	// kind == "killswitch", "tenants", "dns" or "nat"
+	Backend string `json:"backend,omitempty"`
+	// kind == "nat"
+	Tunnel string `json:"tunnel,omitempty"`
 
-	interfaceToClose *water.Interface
+	// kind == "dns" or "sysctl": the configuration prior to the change
+	Servers []string `json:"servers,omitempty"`
+	Search  []string `json:"search,omitempty"`
+	Data    string   `json:"data,omitempty"`
+	// kind == "dns": the target if resolv.conf was a symlink, or whether it
+	// did not exist
+	Link   string `json:"link,omitempty"`
+	Absent bool   `json:"absent,omitempty"`
 }
 
-type routeEntries struct {
-	dest net.IP
-	via  net.IP
-	dev  string
+// AddRoute adds a route to the system routing table, recording it so it is
+// deleted when Close() is called.
+func (r *Reverser) AddRoute(destination *net.IPNet, via net.IP, dev string, debug bool) error {
+	e := journalEntry{Kind: "route", Dest: destination.String(), Dev: dev}
+	if via != nil {
+		e.Via = via.String()
+	}
+	return r.apply(e, func() error {
+		return AddRoute(destination, via, dev, debug)
+	})
 }
 
-// AddRouteEntry adds a route to the deletion set so it is deleted from the
-// routing table when Reverse() is called.
-func (r *Reverser) AddRouteEntry(destination net.IP, via net.IP, dev string) {
-	r.RouteDeletions = append(r.RouteDeletions, routeEntries{
-		dest: destination,
-		via:  via,
-		dev:  dev,
+// DelRoute deletes a route added with AddRoute, which is then no longer
+// deleted when Close() is called. The route is forgotten even if deleting it
+// fails, as it may already have been removed with its interface.
+func (r *Reverser) DelRoute(destination *net.IPNet, via net.IP, dev string, debug bool) error {
+	err := DelRoute(destination, via, dev, debug)
+	var viaStr string
+	if via != nil {
+		viaStr = via.String()
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		e := r.entries[i]
+		if e.Kind == "route" && e.Table == 0 && e.Dest == destination.String() && e.Via == viaStr && e.Dev == dev {
+			r.entries = append(r.entries[:i], r.entries[i+1:]...)
+			break
+		}
+	}
+	if jErr := r.writeJournal(); err == nil {
+		err = jErr
+	}
+	return err
+}
+
+// AddRouteInTable is like AddRoute, but adds the route to the given routing table.
+func (r *Reverser) AddRouteInTable(destination *net.IPNet, via net.IP, dev string, table int, debug bool) error {
+	e := journalEntry{Kind: "route", Dest: destination.String(), Dev: dev, Table: table}
+	if via != nil {
+		e.Via = via.String()
+	}
+	return r.apply(e, func() error {
+		return AddRouteInTable(destination, via, dev, table, debug)
 	})
 }
 
-// ResetGatewayOSX tells the reverser what gateway should be set on exit.
-func (r *Reverser) ResetGatewayOSX(intf *water.Interface, gw string) {
-	r.updateGateway = true
-	r.newGW = gw
-	r.interfaceToClose = intf
+// AddRule adds a policy routing rule looking up traffic arriving on iif in
+// the given table, recording it so it is deleted when Close() is called.
+func (r *Reverser) AddRule(iif string, table int, ipv6 bool, debug bool) error {
+	return r.apply(journalEntry{Kind: "rule", Dev: iif, Table: table, IPv6: ipv6}, func() error {
+		return AddRule(iif, table, ipv6, debug)
+	})
+}
+
+// EnableKillSwitch installs the kill switch firewall rules, recording them so
+// they are removed when Close() is called. See EnableKillSwitch().
+func (r *Reverser) EnableKillSwitch(iName string, endpoints []*net.TCPAddr, allowNets []*net.IPNet, debug bool) error {
+	backend, err := FirewallBackend()
+	if err != nil {
+		return err
+	}
+	return r.apply(journalEntry{Kind: "killswitch", Backend: backend}, func() error {
+		return EnableKillSwitch(backend, iName, endpoints, allowNets, debug)
+	})
+}
+
+// SetKillSwitchAllowed replaces the networks which the kill switch permits
+// traffic to, using the backend which installed it.
+func (r *Reverser) SetKillSwitchAllowed(allowNets []*net.IPNet, debug bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, e := range r.entries {
+		if e.Kind == "killswitch" {
+			return SetKillSwitchAllowed(e.Backend, allowNets, debug)
+		}
+	}
+	return errors.New("kill switch is not enabled")
+}
+
+// SetDNS configures the system to use the DNS servers & search domains in c,
+// recording the previous configuration so it is restored when Close() is called.
+func (r *Reverser) SetDNS(iName string, c *DNSConfig, routeAll bool, debug bool) error {
+	targets, err := dnsTargets(iName)
+	if err != nil {
+		return err
+	}
+	for _, e := range targets {
+		e := e
+		if err := r.apply(e, func() error { return applyDNS(e, c, routeAll, debug) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetSysctl sets a kernel parameter, recording the previous value so it is
+// restored when Close() is called.
+func (r *Reverser) SetSysctl(key, value string) error {
+	prev, err := GetSysctl(key)
+	if err != nil {
+		return err
+	}
+	if prev == value {
+		return nil
+	}
+	return r.apply(journalEntry{Kind: "sysctl", Dev: key, Data: prev}, func() error {
+		return SetSysctl(key, value)
+	})
+}
+
+// EnableTenantIsolation installs the firewall rules isolating the interfaces
+// of tenants, recording them so they are removed when Close() is called. See
+// EnableTenantIsolation().
+func (r *Reverser) EnableTenantIsolation(ifaces []string, debug bool) error {
+	backend, err := FirewallBackend()
+	if err != nil {
+		return err
+	}
+	return r.apply(journalEntry{Kind: "tenants", Backend: backend}, func() error {
+		return EnableTenantIsolation(backend, ifaces, debug)
+	})
+}
+
+// EnableNAT installs NAT & forwarding rules for network, recording them so
+// they are removed when Close() is called. See EnableNAT().
+func (r *Reverser) EnableNAT(tunnel, egress string, network *net.IPNet, debug bool) error {
+	backend, err := NATBackend(network)
+	if err != nil {
+		return err
+	}
+	e := journalEntry{Kind: "nat", Backend: backend, Tunnel: tunnel, Dev: egress, Dest: network.String()}
+	return r.apply(e, func() error {
+		return EnableNAT(backend, tunnel, egress, network, debug)
+	})
+}
+
+// apply journals e, then makes the change with fn. The entry is discarded
+// if fn fails.
+func (r *Reverser) apply(e journalEntry, fn func() error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.entries = append(r.entries, e)
+	if err := r.writeJournal(); err != nil {
+		r.entries = r.entries[:len(r.entries)-1]
+		return err
+	}
+	if err := fn(); err != nil {
+		r.entries = r.entries[:len(r.entries)-1]
+		r.writeJournal()
+		return err
+	}
+	return nil
+}
+
+// writeJournal atomically replaces the journal on disk with the current
+// set of entries. Must be called with lock held.
+func (r *Reverser) writeJournal() error {
+	if r.JournalPath == "" {
+		return nil
+	}
+	if len(r.entries) == 0 {
+		err := os.Remove(r.JournalPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	d, err := json.MarshalIndent(r.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.JournalPath), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(r.JournalPath), ".journal")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(d); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	f.Close()
+	return os.Rename(f.Name(), r.JournalPath)
+}
+
+// undo reverses the change described by e.
+func (e journalEntry) undo() {
+	switch e.Kind {
+	case "route":
+		_, dest, err := net.ParseCIDR(e.Dest)
+		if err != nil {
+			log.Printf("Error: Invalid journalled route %q - %s\n", e.Dest, err.Error())
+			return
+		}
+		via := net.ParseIP(e.Via)
+		if e.Table != 0 {
+			err = DelRouteInTable(dest, via, e.Dev, e.Table, true)
+		} else {
+			err = DelRoute(dest, via, e.Dev, true)
+		}
+		if err == nil {
+			log.Printf("Deleted route to %s via %s on %s\n", e.Dest, e.Via, e.Dev)
+		} else {
+			log.Printf("Error: Route delete %s (%s on %s) - %s\n", e.Dest, e.Via, e.Dev, err.Error())
+		}
+	case "rule":
+		if err := DelRule(e.Dev, e.Table, e.IPv6, true); err == nil {
+			log.Printf("Deleted rule for %s to table %d\n", e.Dev, e.Table)
+		} else {
+			log.Printf("Error: Rule delete for %s to table %d - %s\n", e.Dev, e.Table, err.Error())
+		}
+	case "killswitch":
+		if err := DisableKillSwitch(e.Backend, true); err == nil {
+			log.Printf("Removed kill switch (%s)\n", e.Backend)
+		} else {
+			log.Printf("Error: Removing kill switch (%s) - %s\n", e.Backend, err.Error())
+		}
+	case "tenants":
+		if err := DisableTenantIsolation(e.Backend, true); err == nil {
+			log.Printf("Removed tenant isolation (%s)\n", e.Backend)
+		} else {
+			log.Printf("Error: Removing tenant isolation (%s) - %s\n", e.Backend, err.Error())
+		}
+	case "dns":
+		if err := undoDNS(e); err == nil {
+			log.Printf("Restored DNS configuration of %s (%s)\n", e.Dev, e.Backend)
+		} else {
+			log.Printf("Error: Restoring DNS configuration of %s (%s) - %s\n", e.Dev, e.Backend, err.Error())
+		}
+	case "sysctl":
+		if err := SetSysctl(e.Dev, e.Data); err == nil {
+			log.Printf("Restored %s to %s\n", e.Dev, e.Data)
+		} else {
+			log.Printf("Error: Restoring %s to %s - %s\n", e.Dev, e.Data, err.Error())
+		}
+	case "nat":
+		_, network, err := net.ParseCIDR(e.Dest)
+		if err != nil {
+			log.Printf("Error: Invalid journalled NAT network %q - %s\n", e.Dest, err.Error())
+			return
+		}
+		if err := DisableNAT(e.Backend, e.Tunnel, e.Dev, network, true); err == nil {
+			log.Printf("Removed NAT of %s via %s (%s)\n", e.Dest, e.Dev, e.Backend)
+		} else {
+			log.Printf("Error: Removing NAT of %s via %s (%s) - %s\n", e.Dest, e.Dev, e.Backend, err.Error())
+		}
+	default:
+		log.Printf("Error: Unknown journal entry kind %q\n", e.Kind)
+	}
 }
 
 // Close applies the changes specified in reverser, such to reverse changes
 // to system configuration.
 func (r *Reverser) Close() {
-	for _, route := range r.RouteDeletions {
-		e := DelRoute(route.dest, route.via, route.dev, true)
-		if e == nil {
-			log.Printf("Deleted route to %s via %s on %s\n", route.dest.String(), route.via.String(), route.dev)
-		} else {
-			log.Printf("Error: Route delete %s (%s on %s) - %s\n", route.dest.String(), route.via.String(), route.dev, e.Error())
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		r.entries[i].undo()
+	}
+	r.entries = nil
+	if err := r.writeJournal(); err != nil {
+		log.Printf("Error: Could not clear journal %s - %s\n", r.JournalPath, err.Error())
+	}
+}
+
+// LockJournal takes an exclusive lock on the journal at path, which is held
+// until the returned file is closed or the process exits. The journal must
+// only be restored while holding the lock, so the changes of a process which
+// is still running are not undone.
+func LockJournal(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrJournalInUse
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// RemoveKillSwitch removes the kill switch recorded in the journal at path,
+// using the firewall backend which installed it, and drops it from the
+// journal even if removing it fails, as it may already have been removed.
+// The current backend is used if the journal has no record of it.
+// The caller must hold the lock (see LockJournal).
+func RemoveKillSwitch(path string) error {
+	r := Reverser{JournalPath: path}
+	d, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(d, &r.entries); err != nil {
+			return err
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var found bool
+	var firstErr error
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		if e := r.entries[i]; e.Kind == "killswitch" {
+			if err := DisableKillSwitch(e.Backend, true); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			r.entries = append(r.entries[:i], r.entries[i+1:]...)
+			found = true
+		}
+	}
+	if !found {
+		backend, err := FirewallBackend()
+		if err != nil {
+			return err
 		}
+		return DisableKillSwitch(backend, true)
 	}
-	if r.updateGateway {
-		r.interfaceToClose.Close()
-		commandExec("route", []string{"add", "default", r.newGW}, false)
+	if err := r.writeJournal(); firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// RestoreJournal reverses any changes recorded in the journal at path by a
+// previous process which did not exit cleanly, then removes the journal.
+// The caller must hold the lock (see LockJournal).
+func RestoreJournal(path string) error {
+	d, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r := Reverser{JournalPath: path}
+	if err := json.Unmarshal(d, &r.entries); err != nil {
+		return err
 	}
+	log.Printf("Restoring %d changes from journal %s\n", len(r.entries), path)
+	r.Close()
+	return nil
 }
@@ -0,0 +1,149 @@
+package subnet
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	// roamSettleTime is how long to wait after a network change before
+	// acting on it, as changes tend to come in bursts.
+	roamSettleTime = 2 * time.Second
+	// maxReconnectDelay caps the time between reconnection attempts.
+	maxReconnectDelay = time.Minute
+)
+
+// reconnectDelay returns how long to wait after the given number of failed
+// reconnection attempts. The delay grows quadratically to maxReconnectDelay,
+// less up to 20% jitter so clients of a failed server don't return in lockstep.
+func reconnectDelay(attempt int) time.Duration {
+	d := maxReconnectDelay
+	if attempt < 10 {
+		d = time.Duration(attempt*attempt*5) * time.Second
+		if d > maxReconnectDelay {
+			d = maxReconnectDelay
+		}
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// waitRetry sleeps for d, or until a retry is requested.
+func (c *Client) waitRetry(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-c.retry:
+	}
+}
+
+// reestablish reconnects to the server now: either by dropping the current
+// connection, or by cutting short the wait before the next attempt.
+func (c *Client) reestablish() {
+	if c.connectionOk {
+		c.tlsConn.Close() // reconnects via connectionProblem()
+		return
+	}
+	select {
+	case c.retry <- struct{}{}:
+	default:
+	}
+}
+
+// roamRoutine re-establishes the connection when the network changes in a
+// way which breaks it, such as moving from one network to another.
+func (c *Client) roamRoutine(changes <-chan struct{}) {
+	for !c.isShuttingDown {
+		<-changes
+		time.Sleep(roamSettleTime)
+		select {
+		case <-changes:
+		default:
+		}
+		if !c.isShuttingDown {
+			c.networkChanged()
+		}
+	}
+}
+
+func (c *Client) networkChanged() {
+	if c.killSwitchLAN {
+		c.updateKillSwitchLAN()
+	}
+
+	gw, dev, err := GetNetGateway()
+	if err != nil {
+		return // no default route yet, wait for the next change
+	}
+	gateway := net.ParseIP(gw)
+	moved := !gateway.Equal(c.gateway) || dev != c.gatewayDev
+	if moved {
+		log.Printf("Default gateway changed to %s on %s.\n", gw, dev)
+		if c.newGateway != "" {
+			c.rerouteBypass(gateway, dev)
+		}
+		c.gateway, c.gatewayDev = gateway, dev
+	}
+	// While disconnected, the old connection's address says nothing about
+	// this change, and retrying on every event would defeat the backoff.
+	if c.connectionOk && c.tcpConn != nil && !localAddrPresent(c.tcpConn.LocalAddr()) {
+		moved = true
+	}
+
+	if moved {
+		log.Println("Network changed, re-establishing connection.")
+		c.reestablish()
+	}
+}
+
+// updateKillSwitchLAN permits traffic to the networks now attached, in place
+// of those attached when the kill switch was enabled.
+func (c *Client) updateKillSwitchLAN() {
+	allow, err := localNetworks(c.intf.Name())
+	if err != nil {
+		log.Printf("Could not list local networks: %s\n", err.Error())
+		return
+	}
+	if fmt.Sprint(allow) == fmt.Sprint(c.killSwitchNets) {
+		return
+	}
+	if err := c.reverser.SetKillSwitchAllowed(allow, c.debugMessages); err != nil {
+		log.Printf("Could not update the networks permitted by the kill switch: %s\n", err.Error())
+		return
+	}
+	c.killSwitchNets = allow
+	log.Printf("Kill switch now permits traffic to %s.\n", allow)
+}
+
+// rerouteBypass moves the routes which bypass the tunnel to a new gateway.
+func (c *Client) rerouteBypass(gateway net.IP, dev string) {
+	for _, n := range c.bypassRoutes() {
+		if err := c.reverser.DelRoute(n, c.gateway, c.gatewayDev, c.debugMessages); err != nil {
+			log.Printf("Could not delete route to %s via %s: %s\n", n, c.gateway, err.Error())
+		}
+		if err := c.reverser.AddRoute(n, gateway, dev, c.debugMessages); err != nil {
+			log.Printf("Could not route %s via %s on %s: %s\n", n, gateway, dev, err.Error())
+			continue
+		}
+		log.Printf("Traffic to %s now routed via %s on %s.\n", n, gateway, dev)
+	}
+}
+
+// localAddrPresent returns false if addr is no longer assigned to an interface.
+func localAddrPresent(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return true
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
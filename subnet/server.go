@@ -1,13 +1,16 @@
 package subnet
 
 import (
+	"crypto/ecdh"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/twitchyliquid64/subnet/subnet/cert"
 	"github.com/twitchyliquid64/subnet/subnet/conn"
 
 	"github.com/songgao/water"
@@ -15,42 +18,239 @@ import (
 
 //Server represents a service providing a VPN service to subnet clients.
 type Server struct {
-	tlsConf        *tls.Config
-	tlsListener    net.Listener
+	tlsConf   *tls.Config
+	listener  net.Listener
+	transport conn.Transport
+
+	noisePeers map[string]*NoisePeer
+	authUsers  map[string]*AuthUser
+
+	limits         clientLimits
+	quotas         *quotaStore
+	eventCmd       string
+	dns            *DNSConfig
+	dnsZone        string
+	dnsUpstream    string
+	dnsResponder   *dnsResponder
+	natInterface   string
+	layer2         bool
+	bridge         string
+	sw             *l2Switch
+	mcast          *multicastRouter
+	isolate        bool
+	groups         *clientGroups
 	localAddr      net.IP
 	localNetMask   *net.IPNet
 	isShuttingDown bool
 
 	clientIDByAddress map[string]int
 	clients           map[int]*serverConn
+	sessions          map[string]*serverConn
+	sessionGrace      time.Duration
 	clientsLock       sync.Mutex
 	lastClientID      int
 
 	inboundIPPkts   chan *inboundIPPkt
-	inboundDevPkts  chan *IPPacket
-	outboundDevPkts chan *IPPacket
+	inboundDevPkts  *packetQueue
+	outboundDevPkts *packetQueue
+
+	table       int
+	foreignNets []*net.IPNet // networks of other tenants, which clients may not reach
+	fed         *federation
+	ws          *webSocketServer
+
+	fallback    string
+	serverNames []string
 
 	intf     *water.Interface
-	reverser Reverser
+	reverser *Reverser
 	wg       sync.WaitGroup
 }
 
+// ServerOptions describes optional behaviour of a Server.
+type ServerOptions struct {
+	// KernelTLS hands encryption of client streams to the kernel after
+	// the handshake, where supported.
+	KernelTLS bool
+	// ObfuscationKey, if set, disguises client connections with the
+	// obfuscated transport (see conn.ObfsTransport), keyed by it. Clients
+	// must use the same key.
+	ObfuscationKey []byte
+
+	// NoiseKey, if set, authenticates clients with a Noise handshake using
+	// static keys (see conn.NoiseTransport), rather than TLS & certificates.
+	// Clients are identified by the name of their public key in the JSON file
+	// at NoisePeersPath.
+	NoiseKey       *ecdh.PrivateKey
+	NoisePeersPath string
+
+	// AuthUsersPath, if set, is the path to a JSON file of the second
+	// factors (see AuthUser) of each client identity. Clients must answer a
+	// challenge for them after the handshake, before any packets are
+	// exchanged. Identities without an entry are rejected.
+	AuthUsersPath string
+
+	// LimitsPath is the path to a JSON file describing per-client bandwidth
+	// limits and quotas.
+	LimitsPath string
+	// QuotaStatePath is the path at which quota usage is persisted.
+	QuotaStatePath string
+	// EventCmd is run with the kind, client identity & detail of each event.
+	EventCmd string
+
+	// DNS is sent to each client on connection, for use while connected.
+	DNS *DNSConfig
+	// DNSZone enables a DNS server on the server's VPN address, which
+	// resolves <client name>.<DNSZone> to the addresses of connected clients.
+	DNSZone string
+	// DNSUpstream is the resolver queries outside DNSZone are forwarded to.
+	// The first nameserver in /etc/resolv.conf is used if empty.
+	DNSUpstream string
+
+	// NATInterface enables IP forwarding, and masquerades traffic from the
+	// VPN network leaving via this interface. If "auto", the interface of
+	// the default route is used.
+	NATInterface string
+
+	// Layer2 carries ethernet frames over a TAP device rather than IP
+	// packets over a TUN device, switching frames between clients.
+	Layer2 bool
+	// Bridge adds the TAP device to this bridge, rather than assigning it
+	// an address. Layer2 only.
+	Bridge string
+
+	// Multicast enables replication of multicast & broadcast packets between
+	// clients: MulticastFlood sends them to every client, MulticastSnoop only
+	// to clients which have subscribed to the group. Layer 3 only.
+	Multicast string
+	// MulticastGroups limits the multicast groups which are replicated. All
+	// groups are replicated if empty.
+	MulticastGroups []*net.IPNet
+	// MulticastAllowPath, if set, is the path to a JSON file of the
+	// multicast groups each client, or the members of each client group
+	// (see GroupsPath), may send & receive, within MulticastGroups. See
+	// ReadMulticastAllow.
+	MulticastAllowPath string
+
+	// IsolateClients prevents clients from communicating with each other,
+	// unless they share a group in the JSON file at GroupsPath. Clients can
+	// still reach the server and the networks behind it.
+	IsolateClients bool
+	GroupsPath     string
+
+	// RoutingTable, if non-zero, is the kernel routing table used for traffic
+	// arriving from clients. A route to the VPN network is added to it.
+	RoutingTable int
+
+	// PeerListen is the address on which links from peer servers are
+	// accepted. Peers lists the addresses of peer servers to link to. Peer
+	// certificates must be signed by the CA at PeerCAPath.
+	PeerListen string
+	Peers      []string
+	PeerCAPath string
+
+	// WebSocketListen is the address on which clients are accepted over a
+	// WebSocket at WebSocketPath, served over HTTPS, or plain HTTP if
+	// WebSocketPlain is set (behind a reverse proxy which terminates TLS).
+	WebSocketListen string
+	WebSocketPath   string
+	WebSocketPlain  bool
+
+	// Fallback, if set, is the address of a service (such as a web server)
+	// sharing the server's port. Connections which do not negotiate subnet's
+	// ALPN protocol, or ask for one of ServerNames, are proxied to it.
+	Fallback    string
+	ServerNames []string
+
+	// SessionGrace is how long the routes of a disconnected client are kept,
+	// and packets for it buffered, so it can resume its session by
+	// reconnecting. Clients are removed immediately if zero.
+	SessionGrace time.Duration
+
+	// JournalPath is where changes to network configuration are recorded,
+	// so they can be undone after an unclean exit.
+	JournalPath string
+}
+
 // NewServer returns a new server object representing a VPN service.
 func NewServer(servHost, port, network, iName string,
-	certPemPath, keyPemPath, caCertPath string) (*Server, error) {
-	tlsConf, err := conn.TLSConfig(certPemPath, keyPemPath, caCertPath)
+	certPemPath, keyPemPath, caCertPath string, opts ServerOptions) (*Server, error) {
+	var tlsConf *tls.Config
+	if opts.NoiseKey == nil {
+		var err error
+		if tlsConf, err = conn.TLSConfig(certPemPath, keyPemPath, caCertPath); err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := newServer(network, iName, tlsConf, &Reverser{JournalPath: opts.JournalPath}, opts)
 	if err != nil {
 		return nil, err
 	}
+	if opts.PeerListen != "" || len(opts.Peers) > 0 {
+		if s.fed, err = newFederation(s, certPemPath, keyPemPath, opts.PeerCAPath, opts.PeerListen, opts.Peers); err != nil {
+			s.intf.Close()
+			return nil, errors.New("could not set up federation - " + err.Error())
+		}
+	}
+	if opts.WebSocketListen != "" {
+		if opts.WebSocketPath == "" {
+			opts.WebSocketPath = DefaultWebSocketPath
+		}
+		if s.ws, err = newWebSocketServer(s, opts.WebSocketListen, opts.WebSocketPath, opts.WebSocketPlain); err != nil {
+			s.intf.Close()
+			return nil, errors.New("could not set up WebSocket listener - " + err.Error())
+		}
+	}
+	return s, s.Init(servHost + ":" + port)
+}
 
+// newServer returns a server for the VPN network, which does not listen for
+// connections itself.
+func newServer(network, iName string, tlsConf *tls.Config, reverser *Reverser, opts ServerOptions) (*Server, error) {
 	netIP, localNetMask, err := net.ParseCIDR(network)
 	if err != nil {
 		return nil, errors.New("invalid network address/mask - " + err.Error())
 	}
 
-	intf, err := water.NewTUN(iName)
+	var limits clientLimits
+	if opts.LimitsPath != "" {
+		if limits, err = readLimits(opts.LimitsPath); err != nil {
+			return nil, errors.New("could not read limits - " + err.Error())
+		}
+	}
+	var groups *clientGroups
+	if opts.GroupsPath != "" {
+		if groups, err = readGroups(opts.GroupsPath); err != nil {
+			return nil, errors.New("could not read groups - " + err.Error())
+		}
+	}
+	quotas, err := newQuotaStore(opts.QuotaStatePath)
 	if err != nil {
-		return nil, errors.New("Could not create TUN - " + err.Error())
+		return nil, errors.New("could not read quota state - " + err.Error())
+	}
+	var mcastAllow map[string][]*net.IPNet
+	if opts.MulticastAllowPath != "" {
+		if mcastAllow, err = ReadMulticastAllow(opts.MulticastAllowPath); err != nil {
+			return nil, errors.New("could not read multicast allow lists - " + err.Error())
+		}
+	}
+	var noisePeers map[string]*NoisePeer
+	if opts.NoiseKey != nil {
+		if noisePeers, err = ReadNoisePeers(opts.NoisePeersPath); err != nil {
+			return nil, errors.New("could not read noise peers - " + err.Error())
+		}
+	}
+	var authUsers map[string]*AuthUser
+	if opts.AuthUsersPath != "" {
+		if authUsers, err = ReadAuthUsers(opts.AuthUsersPath); err != nil {
+			return nil, errors.New("could not read second factors - " + err.Error())
+		}
+	}
+
+	intf, err := newDevice(iName, opts.Layer2)
+	if err != nil {
+		return nil, err
 	}
 
 	log.Printf("Created iface %s\n", intf.Name())
@@ -61,65 +261,241 @@ func NewServer(servHost, port, network, iName string,
 		localNetMask:      localNetMask,
 		tlsConf:           tlsConf,
 		inboundIPPkts:     make(chan *inboundIPPkt, servMaxInboundPktQueue),
-		inboundDevPkts:    make(chan *IPPacket, pktInMaxBuff),
-		outboundDevPkts:   make(chan *IPPacket, pktOutMaxBuff),
+		inboundDevPkts:    newPacketQueue(pktInMaxBuff, opts.Layer2),
+		outboundDevPkts:   newPacketQueue(pktOutMaxBuff, opts.Layer2),
 		clientIDByAddress: map[string]int{},
 		clients:           map[int]*serverConn{},
+		sessions:          map[string]*serverConn{},
+		sessionGrace:      opts.SessionGrace,
+		noisePeers:        noisePeers,
+		authUsers:         authUsers,
+		limits:            limits,
+		quotas:            quotas,
+		eventCmd:          opts.EventCmd,
+		dns:               opts.DNS,
+		dnsZone:           opts.DNSZone,
+		dnsUpstream:       opts.DNSUpstream,
+		natInterface:      opts.NATInterface,
+		layer2:            opts.Layer2,
+		bridge:            opts.Bridge,
+		isolate:           opts.IsolateClients,
+		groups:            groups,
+		table:             opts.RoutingTable,
+		fallback:          opts.Fallback,
+		serverNames:       opts.ServerNames,
+		reverser:          reverser,
 	}
-
-	return s, s.Init(servHost + ":" + port)
+	if opts.NoiseKey != nil {
+		s.transport = obfuscate(&conn.NoiseTransport{Key: opts.NoiseKey, Authorize: s.authorizeNoisePeer}, opts.ObfuscationKey, &conn.ObfsReplayCache{})
+	} else {
+		s.transport = obfuscate(&conn.TLSTransport{Config: tlsConf, KernelTLS: opts.KernelTLS}, opts.ObfuscationKey, &conn.ObfsReplayCache{})
+	}
+	if s.layer2 {
+		s.sw = newL2Switch()
+	} else if opts.Multicast != "" {
+		s.mcast = newMulticastRouter(opts.Multicast, opts.MulticastGroups, localNetMask)
+		s.mcast.clientAllow, s.mcast.groups = mcastAllow, groups
+	}
+	return s, nil
 }
 
 // Init sets up the server.
 func (s *Server) Init(servHost string) (err error) {
-	s.tlsListener, err = tls.Listen("tcp", servHost, s.tlsConf)
+	s.listener, err = net.Listen("tcp", servHost)
 	if err != nil {
 		return err
 	}
-	if err = SetDevIP(s.intf.Name(), s.localAddr, s.localNetMask, false); err != nil {
+	if s.noisePeers != nil {
+		log.Printf("Listen for Noise on %s\n", servHost)
+	} else {
+		log.Printf("Listen for TLS on %s\n", servHost)
+	}
+	if s.fallback != "" {
+		log.Printf("Proxying connections which are not for the VPN to %s\n", s.fallback)
+	}
+	return s.setupDevice()
+}
+
+// setupDevice configures the TUN/TAP device, and the rest of the system
+// configuration the server needs.
+func (s *Server) setupDevice() (err error) {
+	if s.bridge != "" {
+		// The device is removed from the bridge by the kernel when it is closed.
+		if err = SetBridge(s.intf.Name(), s.bridge, false); err != nil {
+			return err
+		}
+		if err = SetInterfaceStatus(s.intf.Name(), true, false); err != nil {
+			return err
+		}
+		log.Printf("Added %s to bridge %s\n", s.intf.Name(), s.bridge)
+	} else if err = SetDevIP(s.intf.Name(), s.localAddr, s.localNetMask, false); err != nil {
+		return err
+	}
+	log.Printf("IP of %s set to %s, localNetMask %s\n", s.intf.Name(), s.localAddr.String(), net.IP(s.localNetMask.Mask).String())
+
+	if s.table != 0 {
+		if err = s.setupRoutingTable(); err != nil {
+			return errors.New("could not set up routing table - " + err.Error())
+		}
+	}
+
+	if s.natInterface != "" {
+		if err = s.setupNAT(); err != nil {
+			return errors.New("could not set up NAT - " + err.Error())
+		}
+	}
+
+	if s.dnsZone != "" {
+		if s.dnsResponder, err = newDNSResponder(s, s.dnsZone, s.dnsUpstream); err != nil {
+			return errors.New("could not start DNS server - " + err.Error())
+		}
+		log.Printf("Serving DNS for %s on %s, forwarding to %q\n", s.dnsResponder.zone, s.localAddr, s.dnsResponder.upstream)
+	}
+	return nil
+}
+
+// setupRoutingTable routes traffic arriving from clients using the server's
+// routing table, which is given a route back to the VPN network.
+func (s *Server) setupRoutingTable() error {
+	if err := s.reverser.AddRouteInTable(s.localNetMask, nil, s.intf.Name(), s.table, false); err != nil {
+		return err
+	}
+	if err := s.reverser.AddRule(s.intf.Name(), s.table, s.localNetMask.IP.To4() == nil, false); err != nil {
+		return err
+	}
+	log.Printf("Traffic from %s now routed using table %d.\n", s.intf.Name(), s.table)
+	return nil
+}
+
+// setupNAT enables forwarding, and masquerades traffic from the VPN network
+// as it leaves via the NAT interface.
+func (s *Server) setupNAT() error {
+	egress := s.natInterface
+	if egress == "auto" {
+		_, dev, err := GetNetGateway()
+		if err != nil {
+			return err
+		}
+		egress = dev
+	}
+
+	if err := s.reverser.SetSysctl(ForwardingSysctl(s.localNetMask.IP), "1"); err != nil {
 		return err
 	}
-	log.Printf("Listen for TLS on %s, IP %s set to %s, localNetMask %s\n",
-		servHost, s.intf.Name(), s.localAddr.String(), net.IP(s.localNetMask.Mask).String())
-	return err
+	if err := s.reverser.EnableNAT(s.intf.Name(), egress, s.localNetMask, false); err != nil {
+		return err
+	}
+	log.Printf("Forwarding enabled, traffic from %s masqueraded via %s.\n", s.localNetMask, egress)
+	return nil
 }
 
 // Run starts the server
 func (s *Server) Run() {
-	go s.acceptRoutine()
+	if s.listener != nil {
+		handle := s.handleClient
+		if s.fallback != "" {
+			handle = routeConns(handle, s.fallback, s.serverNames)
+		}
+		go acceptRoutine(s.listener, handle, &s.wg, &s.isShuttingDown)
+	}
+	if s.fed != nil {
+		s.fed.run()
+	}
+	if s.ws != nil {
+		s.ws.run()
+	}
 	go s.dispatchRoutine()
+	go s.devDispatchRoutine()
+	if s.mcast != nil && s.mcast.mode == MulticastSnoop {
+		go s.igmpQueryRoutine()
+	}
+	if s.dnsResponder != nil {
+		go s.dnsResponder.serve()
+	}
 	go devWriteRoutine(s.intf, s.outboundDevPkts, &s.wg, &s.isShuttingDown)
 	go devReadRoutine(s.intf, s.inboundDevPkts, &s.wg, &s.isShuttingDown)
 }
 
-func (s *Server) acceptRoutine() {
+// acceptRoutine calls handle in a new goroutine for each connection accepted
+// by listener, until shutdown.
+func acceptRoutine(listener net.Listener, handle func(net.Conn), wg *sync.WaitGroup, isShuttingDown *bool) {
 	var tcpListener *net.TCPListener
-	tcpListener, _ = s.tlsListener.(*net.TCPListener)
-	s.wg.Add(1)
-	defer s.wg.Done()
+	tcpListener, _ = listener.(*net.TCPListener)
+	wg.Add(1)
+	defer wg.Done()
 
-	for !s.isShuttingDown {
+	for !*isShuttingDown {
 		if tcpListener != nil {
 			tcpListener.SetDeadline(time.Now().Add(time.Millisecond * 300))
 		}
-		conn, err := s.tlsListener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			if !s.isShuttingDown {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			if !*isShuttingDown {
 				log.Printf("Listener err: %s\n", err.Error())
 			}
 			return
 		}
-		s.handleClient(conn)
+		go handle(conn)
+	}
+}
+
+func (s *Server) handleClient(rawConn net.Conn) {
+	tlsConn, err := s.transport.Server(rawConn)
+	if err != nil {
+		log.Printf("Handshake with %s failed: %s\n", rawConn.RemoteAddr().String(), err.Error())
+		return
+	}
+	s.serveConn(tlsConn, peerIdentity(tlsConn))
+}
+
+// obfuscate wraps inner in the obfuscated transport, if obfsKey is set.
+// Servers pass a replay cache shared by all their connections.
+func obfuscate(inner conn.Transport, obfsKey []byte, replays *conn.ObfsReplayCache) conn.Transport {
+	if obfsKey != nil {
+		return &conn.ObfsTransport{Key: obfsKey, Inner: inner, Replays: replays}
+	}
+	return inner
+}
+
+// peerIdentity returns the identity of the client at the other end of c: the
+// name of its Noise key, or else that of its certificate.
+func peerIdentity(c net.Conn) string {
+	if name := conn.PeerName(c); name != "" {
+		return name
 	}
+	if peerCert := conn.PeerCertificate(c); peerCert != nil {
+		return cert.Identity(peerCert)
+	}
+	return ""
 }
 
-func (s *Server) handleClient(conn net.Conn) {
+// serveConn enrolls a client which has authenticated as identity, once it
+// has presented its second factors (if required).
+func (s *Server) serveConn(tlsConn net.Conn, identity string) {
+	if s.authUsers != nil && !s.authenticate(tlsConn, identity) {
+		tlsConn.Close()
+		return
+	}
 	c := serverConn{
-		conn:      conn,
-		canSendIP: true,
+		conn:           tlsConn,
+		identity:       identity,
+		session:        newSessionID(),
+		canSendIP:      true,
+		outboundIPPkts: newPacketQueue(servPerClientPktQueue, s.layer2),
+	}
+	if !c.applyLimits(s) {
+		tlsConn.Close()
+		return
 	}
 	s.enrollClientConn(&c)
 	c.initClient(s)
+	if s.mcast != nil && s.mcast.mode == MulticastSnoop {
+		// Learn the groups the client is already subscribed to.
+		c.queueIP(igmpQuery(s.localAddr))
+	}
 }
 
 func (s *Server) enrollClientConn(c *serverConn) {
@@ -128,18 +504,23 @@ func (s *Server) enrollClientConn(c *serverConn) {
 	c.id = s.lastClientID
 	s.lastClientID++
 	s.clients[c.id] = c
+	if c.session != "" {
+		s.sessions[c.session] = c
+	}
 }
 
 func (s *Server) setAddrForClient(id int, addr net.IP) {
 	s.clientsLock.Lock()
-	defer s.clientsLock.Unlock()
-
 	s.clientIDByAddress[addr.String()] = id
+	s.clientsLock.Unlock()
+
+	if s.fed != nil {
+		s.fed.advertise(addr)
+	}
 }
 
 func (s *Server) removeClientConn(id int) {
 	s.clientsLock.Lock()
-	defer s.clientsLock.Unlock()
 
 	//delete from the clientIDByAddress map if it exists
 	var toDeleteAddrs []string
@@ -151,30 +532,145 @@ func (s *Server) removeClientConn(id int) {
 	for _, addr := range toDeleteAddrs {
 		delete(s.clientIDByAddress, addr)
 	}
+	if c, ok := s.clients[id]; ok {
+		delete(s.sessions, c.session)
+	}
 	delete(s.clients, id)
+	if s.sw != nil {
+		s.sw.forget(id)
+	}
+	if s.mcast != nil {
+		s.mcast.forget(id)
+	}
+	s.clientsLock.Unlock()
+
+	if s.fed != nil {
+		var addrs []net.IP
+		for _, addr := range toDeleteAddrs {
+			addrs = append(addrs, net.ParseIP(addr))
+		}
+		s.fed.withdraw(addrs...)
+	}
 }
 
-// routing from inboundIPPkts/inboundDevPkts to client/TUN.
+// routing from inboundIPPkts to client/TUN.
 func (s *Server) dispatchRoutine() {
 	for !s.isShuttingDown {
-		select {
-		case pkt := <-s.inboundIPPkts:
-			//log.Printf("Got packet from NET: %s-%d len %d\n", pkt.pkt.Dest, pkt.clientID, len(pkt.pkt.Raw))
-			s.route(pkt.pkt)
-		case pkt := <-s.inboundDevPkts:
-			//log.Printf("Got packet from DEV: %s len %d\n", pkt.Dest, len(pkt.Raw))
-			s.route(pkt)
+		pkt := <-s.inboundIPPkts
+		//log.Printf("Got packet from NET: %s-%d len %d\n", pkt.pkt.Dest, pkt.clientID, len(pkt.pkt.Raw))
+		if s.layer2 {
+			s.switchFrame(pkt.pkt, pkt.clientID)
+		} else {
+			s.route(pkt.pkt, pkt.clientID)
 		}
 	}
 }
 
-func (s *Server) route(pkt *IPPacket) {
+// routing from inboundDevPkts to client/TUN.
+func (s *Server) devDispatchRoutine() {
+	for !s.isShuttingDown {
+		pkt, ok := s.inboundDevPkts.Dequeue()
+		if !ok {
+			return
+		}
+		//log.Printf("Got packet from DEV: %s len %d\n", pkt.Dest, len(pkt.Raw))
+		if s.layer2 {
+			s.switchFrame(pkt, devPort)
+		} else {
+			s.route(pkt, devPort)
+		}
+	}
+}
+
+// mayCommunicate returns true if traffic may pass from one client (or devPort)
+// to another. Packets forwarded by a peer are treated as from the client whose
+// identity they carry, or the TUN device if none. Must be called with
+// clientsLock held.
+func (s *Server) mayCommunicate(pkt *IPPacket, from, to int) bool {
+	if !s.isolate || from == devPort || to == devPort || from == to {
+		return true
+	}
+	b := s.clients[to]
+	if from == peerPort {
+		return b != nil && (pkt.identity == "" || s.groups.share(pkt.identity, b.identity))
+	}
+	a := s.clients[from]
+	return a != nil && b != nil && s.groups.share(a.identity, b.identity)
+}
+
+// switchFrame forwards an ethernet frame received on srcPort (a client ID, or
+// devPort for the TAP device) to the port(s) it is destined for.
+func (s *Server) switchFrame(pkt *IPPacket, srcPort int) {
+	port, flood := s.sw.forward(pkt.Raw, srcPort)
+	if !flood && port == switchNoPort {
+		return
+	}
+
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	if !flood {
+		if s.mayCommunicate(pkt, srcPort, port) {
+			s.sendToPort(pkt, port)
+		}
+		return
+	}
+	if srcPort != devPort {
+		s.sendToPort(pkt, devPort)
+	}
+	for id := range s.clients {
+		if id != srcPort && s.mayCommunicate(pkt, srcPort, id) {
+			s.sendToPort(pkt, id)
+		}
+	}
+}
+
+// sendToPort queues a copy of pkt to a client or the TAP device. Must be
+// called with clientsLock held.
+func (s *Server) sendToPort(pkt *IPPacket, port int) {
+	cp := *pkt
+	if port == devPort {
+		s.outboundDevPkts.Enqueue(&cp)
+	} else if c, ok := s.clients[port]; ok {
+		c.queueIP(&cp)
+	}
+}
+
+// dataPktType returns the type of packet carrying tunnelled traffic.
+func (s *Server) dataPktType() conn.PktType {
+	if s.layer2 {
+		return conn.PktEthFrame
+	}
+	return conn.PktIPPkt
+}
+
+// route forwards an IP packet from a client (or devPort for the TUN device) to
+// the client it is addressed to, or otherwise the TUN device.
+func (s *Server) route(pkt *IPPacket, from int) {
+	if from == peerPort && (pkt.Dest.IsMulticast() || s.mcast != nil && s.mcast.isBroadcast(pkt.Dest)) {
+		return
+	}
+	if s.mcast != nil && (pkt.Dest.IsMulticast() || s.mcast.isBroadcast(pkt.Dest)) {
+		s.replicate(pkt, from)
+		return
+	}
 	if pkt.Dest.IsMulticast() { //Don't forward multicast
 		return
 	}
+	if from != devPort {
+		for _, n := range s.foreignNets {
+			if n.Contains(pkt.Dest) {
+				return
+			}
+		}
+	}
 
 	s.clientsLock.Lock()
 	destClientID, canRouteDirectly := s.clientIDByAddress[pkt.Dest.String()]
+	if canRouteDirectly && !s.mayCommunicate(pkt, from, destClientID) {
+		// Dropped rather than sent to the TUN device, which would route it back.
+		s.clientsLock.Unlock()
+		return
+	}
 	if canRouteDirectly {
 		destClient, clientExists := s.clients[destClientID]
 		if clientExists {
@@ -185,25 +681,116 @@ func (s *Server) route(pkt *IPPacket) {
 		}
 	}
 	s.clientsLock.Unlock()
+	if !canRouteDirectly && from != peerPort && s.fed != nil {
+		// Packets from peers are not forwarded to other peers, to avoid loops.
+		if peer := s.fed.lookup(pkt.Dest); peer != nil {
+			s.clientsLock.Lock()
+			if c, ok := s.clients[from]; ok {
+				pkt.identity = c.identity
+			}
+			s.clientsLock.Unlock()
+			peer.queueIP(pkt)
+			return
+		}
+	}
 	if !canRouteDirectly {
-		s.outboundDevPkts <- pkt
+		s.outboundDevPkts.Enqueue(pkt)
 		//log.Println("Routing to DEV")
 	}
 }
 
+// replicate sends a multicast or broadcast packet to each client (other than
+// the sender) which wants it, and the TUN device.
+func (s *Server) replicate(pkt *IPPacket, from int) {
+	if pkt.Protocol == igmpProtocol && from != devPort {
+		if s.mcast.mode == MulticastSnoop {
+			s.mcast.snoop(pkt.Raw, from)
+		}
+		return
+	}
+	if !s.mcast.allowed(pkt.Dest) {
+		return
+	}
+
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	if from != devPort {
+		if c := s.clients[from]; c == nil || !s.mcast.allowedFor(pkt.Dest, c.identity) {
+			return
+		}
+		s.sendToPort(pkt, devPort)
+	}
+	for id, c := range s.clients {
+		if id != from && s.mayCommunicate(pkt, from, id) && s.mcast.wants(pkt.Dest, id) && s.mcast.allowedFor(pkt.Dest, c.identity) {
+			s.sendToPort(pkt, id)
+		}
+	}
+}
+
+// igmpQueryRoutine periodically asks clients to report their multicast group
+// memberships, so they remain subscribed.
+func (s *Server) igmpQueryRoutine() {
+	for !s.isShuttingDown {
+		time.Sleep(igmpQueryInterval)
+		s.clientsLock.Lock()
+		for id := range s.clients {
+			s.sendToPort(igmpQuery(s.localAddr), id)
+		}
+		s.clientsLock.Unlock()
+	}
+}
+
+// QueueStats returns statistics about the packets queued for the TUN
+// device and each client.
+func (s *Server) QueueStats() map[string]QueueStats {
+	out := map[string]QueueStats{
+		"from-" + s.intf.Name(): s.inboundDevPkts.Stats(),
+		"to-" + s.intf.Name():   s.outboundDevPkts.Stats(),
+	}
+
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	for id, c := range s.clients {
+		out[fmt.Sprintf("to-client-%d", id)] = c.outboundIPPkts.Stats()
+	}
+	if s.fed != nil {
+		s.fed.lock.RLock()
+		for l := range s.fed.links {
+			out["to-peer-"+l.name] = l.outbound.Stats()
+		}
+		s.fed.lock.RUnlock()
+	}
+	return out
+}
+
 // Close shuts down the server, reversing configuration changes to the system.
 func (s *Server) Close() error {
 	s.isShuttingDown = true
 	s.reverser.Close()
+	if err := s.quotas.save(); err != nil {
+		log.Printf("Failed to save quota state: %s\n", err)
+	}
 
-	err := s.tlsListener.Close()
-	if err != nil {
-		return err
+	if s.dnsResponder != nil {
+		s.dnsResponder.Close()
+	}
+	if s.fed != nil {
+		s.fed.close()
+	}
+	if s.ws != nil {
+		s.ws.close()
+	}
+	if s.listener != nil {
+		if err := s.listener.Close(); err != nil {
+			return err
+		}
 	}
-	err = s.intf.Close()
+	err := s.intf.Close()
 	if err != nil {
 		return err
 	}
+	s.inboundDevPkts.Close()
+	s.outboundDevPkts.Close()
 
 	//s.wg.Wait() //who cares
 	return nil
@@ -4,15 +4,36 @@ import (
 	"encoding/gob"
 	"log"
 	"net"
+	"sync"
+	"time"
 
+	"github.com/songgao/water/waterutil"
 	"github.com/twitchyliquid64/subnet/subnet/conn"
 )
 
 type serverConn struct {
-	conn net.Conn
-	id   int
+	conn     net.Conn
+	encoder  *gob.Encoder
+	id       int
+	identity string
 
-	outboundIPPkts chan *IPPacket
+	// session identifies the client's session, which it may resume after
+	// reconnecting. While detached, the client has disconnected but its
+	// routes are kept & packets for it buffered until the grace timer fires.
+	session    string
+	detached   bool
+	noResume   bool
+	graceTimer *time.Timer
+
+	limit   *clientLimit
+	ingress *tokenBucket
+	egress  *tokenBucket
+	// throttled is set while the client is over quota. It is accessed by
+	// both readRoutine & writeRoutine.
+	throttleLock sync.Mutex
+	throttled    bool
+
+	outboundIPPkts *packetQueue
 
 	server      *Server
 	canSendIP   bool
@@ -22,27 +43,49 @@ type serverConn struct {
 }
 
 func (c *serverConn) initClient(s *Server) {
-	c.outboundIPPkts = make(chan *IPPacket, servPerClientPktQueue)
 	c.connectionOk = true
 	c.server = s
-	log.Printf("New connection from %s (%d)\n", c.conn.RemoteAddr().String(), c.id)
+	c.encoder = gob.NewEncoder(c.conn)
+	log.Printf("New connection from %s (%d, %q)\n", c.conn.RemoteAddr().String(), c.id, c.identity)
+	// writeRoutine is started once the first packet from the client has been
+	// read, which may resume an earlier session.
 	go c.readRoutine(&s.isShuttingDown, s.inboundIPPkts)
-	go c.writeRoutine(&s.isShuttingDown)
 }
 
 func (c *serverConn) writeRoutine(isShuttingDown *bool) {
-	encoder := gob.NewEncoder(c.conn)
+	encoder := c.encoder
+	queue := c.outboundIPPkts
+
+	encoder.Encode(conn.PktSession)
+	if err := encoder.Encode(c.session); err != nil {
+		log.Printf("Write error for %s: %s\n", c.conn.RemoteAddr().String(), err.Error())
+		c.hadError(false)
+		return
+	}
+
+	if !c.server.dns.Empty() {
+		encoder.Encode(conn.PktDNSConfig)
+		if err := encoder.Encode(c.server.dns); err != nil {
+			log.Printf("Write error for %s: %s\n", c.conn.RemoteAddr().String(), err.Error())
+			c.hadError(false)
+			return
+		}
+	}
 
 	for !*isShuttingDown && c.connectionOk {
-		select {
-		case pkt := <-c.outboundIPPkts:
-			encoder.Encode(conn.PktIPPkt)
-			err := encoder.Encode(pkt)
-			if err != nil {
-				log.Printf("Write error for %s: %s\n", c.conn.RemoteAddr().String(), err.Error())
-				c.hadError(false)
-				return
-			}
+		pkt, ok := queue.Dequeue()
+		if !ok {
+			return
+		}
+		if !c.account(c.egress, len(pkt.Raw)) {
+			return
+		}
+		encoder.Encode(c.server.dataPktType())
+		err := encoder.Encode(pkt)
+		if err != nil {
+			log.Printf("Write error for %s: %s\n", c.conn.RemoteAddr().String(), err.Error())
+			c.hadError(false)
+			return
 		}
 	}
 }
@@ -50,7 +93,7 @@ func (c *serverConn) writeRoutine(isShuttingDown *bool) {
 func (c *serverConn) readRoutine(isShuttingDown *bool, ipPacketSink chan *inboundIPPkt) {
 	decoder := gob.NewDecoder(c.conn)
 
-	for !*isShuttingDown && c.connectionOk {
+	for first := true; !*isShuttingDown && c.connectionOk; first = false {
 		var pktType conn.PktType
 		err := decoder.Decode(&pktType)
 		if err != nil {
@@ -62,6 +105,17 @@ func (c *serverConn) readRoutine(isShuttingDown *bool, ipPacketSink chan *inboun
 		}
 
 		switch pktType {
+		case conn.PktResume:
+			var session string
+			if err := decoder.Decode(&session); err != nil {
+				log.Printf("Could not decode session: %s", err.Error())
+				c.hadError(false)
+				return
+			}
+			if first {
+				c.server.resumeSession(c, session)
+			}
+
 		case conn.PktLocalAddr:
 			var localAddr net.IP
 			err := decoder.Decode(&localAddr)
@@ -70,10 +124,15 @@ func (c *serverConn) readRoutine(isShuttingDown *bool, ipPacketSink chan *inboun
 				c.hadError(false)
 				return
 			}
+			if !c.server.addrPermitted(c.identity, localAddr) {
+				log.Printf("Client %d (%q) may not use address %s. Disconnecting.\n", c.id, c.identity, localAddr)
+				c.hadError(false)
+				return
+			}
 			c.remoteAddrs = append(c.remoteAddrs, localAddr)
 			c.server.setAddrForClient(c.id, localAddr)
 
-		case conn.PktIPPkt:
+		case conn.PktIPPkt, conn.PktEthFrame:
 			var ipPkt IPPacket
 			err := decoder.Decode(&ipPkt)
 			if err != nil {
@@ -81,18 +140,115 @@ func (c *serverConn) readRoutine(isShuttingDown *bool, ipPacketSink chan *inboun
 				c.hadError(false)
 				return
 			}
+			if pktType != c.server.dataPktType() {
+				log.Printf("Client %d is not using the same -layer as the server. Disconnecting.\n", c.id)
+				c.hadError(false)
+				return
+			}
+			if pktType == conn.PktIPPkt && !c.checkPacket(&ipPkt) {
+				continue
+			}
 			//log.Printf("Packet Received from %d: dest %s, len %d\n", c.id, ipPkt.Dest.String(), len(ipPkt.Raw))
+			if !c.account(c.ingress, len(ipPkt.Raw)) {
+				return
+			}
 			ipPacketSink <- &inboundIPPkt{pkt: &ipPkt, clientID: c.id}
 		}
+
+		if first {
+			go c.writeRoutine(isShuttingDown)
+		}
 	}
 }
 
-func (c *serverConn) queueIP(pkt *IPPacket) {
-	select {
-	case c.outboundIPPkts <- pkt:
-	default:
-		log.Printf("Warning: Dropping packets for %s as outbound msg queue is full.\n", c.remoteAddressStr())
+// checkPacket sets the destination & protocol of an IP packet from its
+// header, rather than trusting those sent by the client, which isolation &
+// routing depend on. Returns false if the packet should be dropped, as it is
+// not IPv4 or is not from one of the client's addresses.
+func (c *serverConn) checkPacket(pkt *IPPacket) bool {
+	if len(pkt.Raw) < 20 || !waterutil.IsIPv4(pkt.Raw) {
+		return false
+	}
+	src := waterutil.IPv4Source(pkt.Raw)
+	for _, addr := range c.remoteAddrs {
+		if addr.Equal(src) {
+			pkt.Dest = waterutil.IPv4Destination(pkt.Raw)
+			pkt.Protocol = waterutil.IPv4Protocol(pkt.Raw)
+			return true
+		}
+	}
+	return false
+}
+
+// applyLimits sets up rate limiting for the client, returning false if the
+// client should be refused as it is over quota.
+func (c *serverConn) applyLimits(s *Server) bool {
+	if s.limits == nil {
+		return true
+	}
+	c.limit = s.limits.forIdentity(c.identity)
+	if c.limit == nil {
+		return true
+	}
+	c.ingress = newTokenBucket(c.limit.IngressRate, c.limit.Burst)
+	c.egress = newTokenBucket(c.limit.EgressRate, c.limit.Burst)
+
+	if s.quotas.exceeded(c.identity, c.limit) {
+		if c.limit.OverQuota == "disconnect" {
+			s.emitEvent(EventQuotaDisconnected, c.identity, "refused connection from "+c.conn.RemoteAddr().String())
+			return false
+		}
+		c.setThrottled(true)
 	}
+	return true
+}
+
+// account applies rate limiting & quotas to n bytes passing through the
+// connection, returning false if the client was disconnected.
+func (c *serverConn) account(bucket *tokenBucket, n int) bool {
+	if c.limit == nil {
+		return true
+	}
+	over := c.server.quotas.add(c.identity, c.limit, n)
+	if over && c.limit.OverQuota == "disconnect" {
+		c.server.emitEvent(EventQuotaDisconnected, c.identity, "quota exceeded")
+		c.noResume = true
+		c.hadError(false)
+		return false
+	}
+	if c.setThrottled(over) {
+		if over {
+			c.server.emitEvent(EventQuotaThrottled, c.identity, "quota exceeded")
+		} else {
+			log.Printf("Client %d (%q) is within its quota for the new period, no longer throttled\n", c.id, c.identity)
+		}
+	}
+	bucket.wait(n)
+	return true
+}
+
+// setThrottled limits the client to its throttle rate while it is over
+// quota, and restores its usual rates once a new quota period begins.
+// Returns true if the state changed.
+func (c *serverConn) setThrottled(over bool) bool {
+	c.throttleLock.Lock()
+	defer c.throttleLock.Unlock()
+	if over == c.throttled {
+		return false
+	}
+	c.throttled = over
+	if over {
+		c.ingress.setRate(c.limit.ThrottleRate)
+		c.egress.setRate(c.limit.ThrottleRate)
+	} else {
+		c.ingress.setRate(c.limit.IngressRate)
+		c.egress.setRate(c.limit.EgressRate)
+	}
+	return true
+}
+
+func (c *serverConn) queueIP(pkt *IPPacket) {
+	c.outboundIPPkts.Enqueue(pkt)
 }
 
 func (c *serverConn) remoteAddressStr() string {
@@ -107,5 +263,8 @@ func (c *serverConn) hadError(errInRead bool) {
 		c.conn.Close()
 	}
 	c.connectionOk = false
-	c.server.removeClientConn(c.id)
+	c.outboundIPPkts.Close()
+	if !c.server.detachClientConn(c) {
+		c.server.removeClientConn(c.id)
+	}
 }
@@ -0,0 +1,84 @@
+package subnet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+// newSessionID returns a random identifier for a client session.
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// detachClientConn keeps the routes of a disconnected client for the session
+// grace period, buffering packets for it, so it can resume the session by
+// reconnecting. Returns false if the client should be removed immediately.
+func (s *Server) detachClientConn(c *serverConn) bool {
+	if s.sessionGrace == 0 || c.session == "" || c.noResume || s.isShuttingDown {
+		return false
+	}
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	if c.detached {
+		return true
+	}
+	if s.clients[c.id] != c {
+		return false
+	}
+
+	c.detached = true
+	c.outboundIPPkts = newPacketQueue(servSessionPktBuffer, s.layer2)
+	c.graceTimer = time.AfterFunc(s.sessionGrace, func() { s.expireSession(c) })
+	log.Printf("Client %d (%q) disconnected, keeping its session for %s\n", c.id, c.identity, s.sessionGrace)
+	return true
+}
+
+// resumeSession transfers the routes & buffered packets of a session to c, a
+// new connection from the same client.
+func (s *Server) resumeSession(c *serverConn, session string) {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	old := s.sessions[session]
+	if old == nil || old.identity != c.identity || s.clients[old.id] != old {
+		log.Printf("Client %d (%q) could not resume session, starting a new one\n", c.id, c.identity)
+		return
+	}
+	if old.detached {
+		old.graceTimer.Stop()
+		c.outboundIPPkts.Close()
+		c.outboundIPPkts = old.outboundIPPkts
+	} else {
+		// The client noticed the old connection failing before we did.
+		old.detached = true
+		old.conn.Close()
+	}
+
+	delete(s.clients, c.id)
+	delete(s.sessions, c.session)
+	c.id, c.session = old.id, old.session
+	c.remoteAddrs = old.remoteAddrs
+	s.clients[c.id] = c
+	s.sessions[c.session] = c
+	log.Printf("Client %d (%q) resumed its session, with %d packets buffered\n", c.id, c.identity, c.outboundIPPkts.Stats().Backlog)
+}
+
+// expireSession removes a detached client which did not resume its session
+// within the grace period.
+func (s *Server) expireSession(c *serverConn) {
+	s.clientsLock.Lock()
+	expired := s.clients[c.id] == c
+	s.clientsLock.Unlock()
+	if !expired {
+		return
+	}
+	log.Printf("Session of client %d (%q) expired\n", c.id, c.identity)
+	c.outboundIPPkts.Close()
+	s.removeClientConn(c.id)
+}
@@ -0,0 +1,377 @@
+package subnet
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/twitchyliquid64/subnet/subnet/conn"
+)
+
+// TenantConfig describes one of the VPN networks hosted by a MultiServer.
+type TenantConfig struct {
+	Name string `json:"name"`
+	// CA signs the certificates of the tenant's clients.
+	CA string `json:"ca"`
+	// SNI selects the tenant for clients which send this server name. If Cert
+	// and Key are set, they are presented to those clients instead of the
+	// default server certificate.
+	SNI  string `json:"sni,omitempty"`
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+
+	Network    string `json:"network"`
+	Interface  string `json:"interface,omitempty"`
+	Table      int    `json:"table,omitempty"`
+	Isolate    bool   `json:"isolate,omitempty"`
+	Groups     string `json:"groups,omitempty"`
+	Limits     string `json:"limits,omitempty"`
+	QuotaState string `json:"quota_state,omitempty"`
+	NAT        string `json:"nat,omitempty"`
+}
+
+// ReadTenants reads a JSON file listing the tenants of a MultiServer.
+func ReadTenants(path string) ([]TenantConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file struct {
+		Tenants []TenantConfig `json:"tenants"`
+	}
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return nil, err
+	}
+	if len(file.Tenants) == 0 {
+		return nil, errors.New("no tenants specified")
+	}
+
+	names, snis := map[string]bool{}, map[string]bool{}
+	for _, t := range file.Tenants {
+		switch {
+		case t.Name == "":
+			return nil, errors.New("tenant without a name")
+		case names[t.Name]:
+			return nil, fmt.Errorf("duplicate tenant %q", t.Name)
+		case t.CA == "" || t.Network == "":
+			return nil, fmt.Errorf("tenant %q: ca and network must be specified", t.Name)
+		case t.SNI != "" && snis[t.SNI]:
+			return nil, fmt.Errorf("tenant %q: duplicate sni %q", t.Name, t.SNI)
+		case (t.Cert == "") != (t.Key == ""):
+			return nil, fmt.Errorf("tenant %q: cert and key must be specified together", t.Name)
+		case t.Groups != "" && !t.Isolate:
+			return nil, fmt.Errorf("tenant %q: groups can only be used with isolate", t.Name)
+		}
+		names[t.Name] = true
+		if t.SNI != "" {
+			snis[t.SNI] = true
+		}
+	}
+	return file.Tenants, nil
+}
+
+// MultiServer hosts several isolated VPN networks (tenants) behind a single
+// listener. Each tenant has its own CA, network, device and configuration,
+// and clients are assigned to a tenant by the TLS server name they send, or
+// otherwise by the CA which signed their certificate.
+type MultiServer struct {
+	listener       net.Listener
+	tlsConf        *tls.Config
+	kernelTLS      bool
+	obfsKey        []byte
+	obfsReplays    *conn.ObfsReplayCache
+	tenants        []*tenant
+	reverser       *Reverser
+	fallback       string
+	serverNames    []string
+	isShuttingDown bool
+	wg             sync.WaitGroup
+}
+
+type tenant struct {
+	name    string
+	sni     string
+	ca      *x509.Certificate
+	tlsConf *tls.Config // trusts only the tenant's CA
+	server  *Server
+}
+
+// NewMultiServer returns a server hosting the given tenants. The certificate
+// & key are presented to clients which do not select a tenant by SNI. Options
+// which are set per tenant are ignored in opts.
+func NewMultiServer(servHost, port string, tenants []TenantConfig, certPemPath, keyPemPath string, opts ServerOptions) (*MultiServer, error) {
+	m := &MultiServer{
+		kernelTLS:   opts.KernelTLS,
+		obfsKey:     opts.ObfuscationKey,
+		obfsReplays: &conn.ObfsReplayCache{},
+		reverser:    &Reverser{JournalPath: opts.JournalPath},
+		fallback:    opts.Fallback,
+		serverNames: opts.ServerNames,
+	}
+
+	var cas []*x509.Certificate
+	for _, tc := range tenants {
+		t, err := m.newTenant(tc, certPemPath, keyPemPath, opts)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("tenant %s: %v", tc.Name, err)
+		}
+		m.tenants = append(m.tenants, t)
+		cas = append(cas, t.ca)
+		if t.sni != "" {
+			m.serverNames = append(m.serverNames, t.sni)
+		}
+	}
+	if err := m.isolateTenants(); err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	var err error
+	if m.tlsConf, err = conn.TLSConfigMultiCA(certPemPath, keyPemPath, cas); err != nil {
+		m.Close()
+		return nil, err
+	}
+	// Connections use clones of the config, which must share ticket keys
+	// for sessions to be resumed. Tickets record the tenant, see handleClient.
+	var ticketKey [32]byte
+	if _, err := rand.Read(ticketKey[:]); err != nil {
+		m.Close()
+		return nil, err
+	}
+	m.tlsConf.SetSessionTicketKeys([][32]byte{ticketKey})
+	if m.listener, err = net.Listen("tcp", servHost+":"+port); err != nil {
+		m.Close()
+		return nil, err
+	}
+	log.Printf("Listen for TLS on %s:%s, serving %d tenants\n", servHost, port, len(m.tenants))
+	if m.fallback != "" {
+		log.Printf("Proxying connections which are not for the VPN to %s\n", m.fallback)
+	}
+	return m, nil
+}
+
+func (m *MultiServer) newTenant(tc TenantConfig, certPemPath, keyPemPath string, opts ServerOptions) (*tenant, error) {
+	ca, err := conn.LoadCACert(tc.CA)
+	if err != nil {
+		return nil, errors.New("could not read CA - " + err.Error())
+	}
+	if tc.Cert != "" {
+		certPemPath, keyPemPath = tc.Cert, tc.Key
+	}
+	tlsConf, err := conn.TLSConfigMultiCA(certPemPath, keyPemPath, []*x509.Certificate{ca})
+	if err != nil {
+		return nil, err
+	}
+
+	opts.RoutingTable = tc.Table
+	opts.IsolateClients = tc.Isolate
+	opts.GroupsPath = tc.Groups
+	opts.LimitsPath = tc.Limits
+	opts.QuotaStatePath = tc.QuotaState
+	opts.NATInterface = tc.NAT
+	s, err := newServer(tc.Network, tc.Interface, tlsConf, m.reverser, opts)
+	if err != nil {
+		return nil, err
+	}
+	t := &tenant{name: tc.Name, sni: tc.SNI, ca: ca, tlsConf: tlsConf, server: s}
+	if err := s.setupDevice(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// isolateTenants prevents the clients of each tenant reaching the networks of
+// the others through the server. Packets for them are dropped before reaching
+// the device, and firewall rules drop any forwarded by the kernel between the
+// tenants' devices. Tenants with overlapping networks must use separate
+// routing tables.
+func (m *MultiServer) isolateTenants() error {
+	var ifaces []string
+	for _, t := range m.tenants {
+		for _, o := range m.tenants {
+			if t == o {
+				continue
+			}
+			own, other := t.server.localNetMask, o.server.localNetMask
+			if !own.Contains(other.IP) && !other.Contains(own.IP) {
+				t.server.foreignNets = append(t.server.foreignNets, other)
+			} else if t.server.table == 0 || o.server.table == 0 || t.server.table == o.server.table {
+				return fmt.Errorf("tenants %s and %s have overlapping networks, but do not use separate routing tables", t.name, o.name)
+			}
+		}
+		ifaces = append(ifaces, t.server.intf.Name())
+	}
+	if len(ifaces) < 2 {
+		return nil
+	}
+	if err := m.reverser.EnableTenantIsolation(ifaces, false); err != nil {
+		return errors.New("could not install firewall rules isolating tenants - " + err.Error())
+	}
+	return nil
+}
+
+// Run starts serving each tenant.
+func (m *MultiServer) Run() {
+	for _, t := range m.tenants {
+		t.server.Run()
+	}
+	handle := m.handleClient
+	if m.fallback != "" {
+		handle = routeConns(handle, m.fallback, m.serverNames)
+	}
+	go acceptRoutine(m.listener, handle, &m.wg, &m.isShuttingDown)
+}
+
+func (m *MultiServer) handleClient(rawConn net.Conn) {
+	tlsConn, selected, err := m.handshake(rawConn)
+	if err != nil {
+		log.Printf("Handshake with %s failed: %s\n", rawConn.RemoteAddr().String(), err.Error())
+		return
+	}
+	if selected == nil {
+		log.Printf("No tenant for client %s, closing connection\n", rawConn.RemoteAddr().String())
+		tlsConn.Close()
+		return
+	}
+	selected.server.serveConn(tlsConn, peerIdentity(tlsConn))
+}
+
+// handshake performs the TLS handshake with a client, returning the tenant
+// selected for it, if any.
+func (m *MultiServer) handshake(rawConn net.Conn) (net.Conn, *tenant, error) {
+	// Each connection gets its own config, which records the tenant selected by SNI.
+	var selected *tenant
+	tlsConf := m.tlsConf.Clone()
+	tlsConf.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if selected = m.tenantBySNI(hello.ServerName); selected != nil {
+			return &selected.tlsConf.Certificates[0], nil
+		}
+		return nil, nil
+	}
+	tlsConf.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if selected != nil {
+			return selected.tlsConf.VerifyPeerCertificate(rawCerts, verifiedChains)
+		}
+		return m.tlsConf.VerifyPeerCertificate(rawCerts, verifiedChains)
+	}
+	// Neither of the above are called when a session is resumed, so tickets
+	// carry the tenant which served the session, and a session is only
+	// resumed by the same tenant.
+	tlsConf.WrapSession = func(cs tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+		if selected == nil && len(cs.PeerCertificates) > 0 {
+			selected = m.tenantByCA(cs.PeerCertificates[0])
+		}
+		if selected == nil {
+			return nil, errors.New("no tenant for session ticket")
+		}
+		ss.Extra = append(ss.Extra, []byte(ticketTenantPrefix+selected.name))
+		return m.tlsConf.EncryptTicket(cs, ss)
+	}
+	tlsConf.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+		ss, err := m.tlsConf.DecryptTicket(identity, cs)
+		if ss == nil || err != nil {
+			return ss, err
+		}
+		t := m.ticketTenant(ss)
+		if t == nil {
+			return nil, nil // not resumed, so the handshake selects a tenant
+		}
+		if bySNI := m.tenantBySNI(cs.ServerName); bySNI != nil && bySNI != t {
+			return nil, nil
+		}
+		selected = t
+		return ss, nil
+	}
+
+	tlsConn, err := obfuscate(&conn.TLSTransport{Config: tlsConf, KernelTLS: m.kernelTLS}, m.obfsKey, m.obfsReplays).Server(rawConn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if selected == nil {
+		selected = m.tenantByCA(conn.PeerCertificate(tlsConn))
+	}
+	return tlsConn, selected, nil
+}
+
+func (m *MultiServer) tenantBySNI(name string) *tenant {
+	if name == "" {
+		return nil
+	}
+	for _, t := range m.tenants {
+		if t.sni == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// ticketTenantPrefix starts the entry of a session ticket naming its tenant.
+const ticketTenantPrefix = "subnet-tenant:"
+
+// ticketTenant returns the tenant named in a session ticket.
+func (m *MultiServer) ticketTenant(ss *tls.SessionState) *tenant {
+	for _, e := range ss.Extra {
+		if !strings.HasPrefix(string(e), ticketTenantPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(string(e), ticketTenantPrefix)
+		for _, t := range m.tenants {
+			if t.name == name {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// tenantByCA returns the first tenant whose CA signed c.
+func (m *MultiServer) tenantByCA(c *x509.Certificate) *tenant {
+	if c == nil {
+		return nil
+	}
+	for _, t := range m.tenants {
+		if conn.VerifyCert(c, t.ca) == nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// QueueStats returns the queue statistics of each tenant, prefixed by its name.
+func (m *MultiServer) QueueStats() map[string]QueueStats {
+	out := map[string]QueueStats{}
+	for _, t := range m.tenants {
+		for k, v := range t.server.QueueStats() {
+			out[t.name+"/"+k] = v
+		}
+	}
+	return out
+}
+
+// Close shuts down each tenant, reversing configuration changes to the system.
+func (m *MultiServer) Close() error {
+	m.isShuttingDown = true
+	if m.listener != nil {
+		m.listener.Close()
+	}
+	var firstErr error
+	for _, t := range m.tenants {
+		if err := t.server.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	m.reverser.Close()
+	return firstErr
+}
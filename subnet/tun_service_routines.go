@@ -8,7 +8,7 @@ import (
 	"github.com/songgao/water/waterutil"
 )
 
-func devReadRoutine(dev *water.Interface, packetsIn chan *IPPacket, wg *sync.WaitGroup, isShuttingDown *bool) {
+func devReadRoutine(dev *water.Interface, packetsIn *packetQueue, wg *sync.WaitGroup, isShuttingDown *bool) {
 	wg.Add(1)
 	defer wg.Done()
 
@@ -19,25 +19,28 @@ func devReadRoutine(dev *water.Interface, packetsIn chan *IPPacket, wg *sync.Wai
 			if !*isShuttingDown {
 				log.Printf("%s read err: %s\n", dev.Name(), err.Error())
 			}
-			close(packetsIn)
+			packetsIn.Close()
 			return
 		}
-		p := &IPPacket{
-			Raw:      packet[:n],
-			Dest:     waterutil.IPv4Destination(packet[:n]),
-			Protocol: waterutil.IPv4Protocol(packet[:n]),
+		p := &IPPacket{Raw: packet[:n]}
+		if dev.IsTUN() {
+			p.Dest = waterutil.IPv4Destination(packet[:n])
+			p.Protocol = waterutil.IPv4Protocol(packet[:n])
 		}
-		packetsIn <- p
+		packetsIn.Enqueue(p)
 		//log.Printf("Packet Received: dest %s, len %d\n", p.Dest.String(), len(p.Raw))
 	}
 }
 
-func devWriteRoutine(dev *water.Interface, packetsOut chan *IPPacket, wg *sync.WaitGroup, isShuttingDown *bool) {
+func devWriteRoutine(dev *water.Interface, packetsOut *packetQueue, wg *sync.WaitGroup, isShuttingDown *bool) {
 	wg.Add(1)
 	defer wg.Done()
 
 	for !*isShuttingDown {
-		pkt := <-packetsOut
+		pkt, ok := packetsOut.Dequeue()
+		if !ok {
+			return
+		}
 		w, err := dev.Write(pkt.Raw)
 		if err != nil {
 			log.Printf("Write to %s failed: %s\n", dev.Name(), err.Error())
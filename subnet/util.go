@@ -2,24 +2,37 @@ package subnet
 
 import (
 	"errors"
+	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"os/exec"
-	"time"
+	"strings"
+
+	"github.com/songgao/water"
 )
 
-func hostToIP(addr string) (net.IP, error) {
-	addrs, err := net.LookupIP(addr)
-	if err != nil {
-		return nil, err
+// newDevice creates a TAP device if layer2 is set, otherwise a TUN device.
+func newDevice(iName string, layer2 bool) (*water.Interface, error) {
+	if layer2 {
+		intf, err := water.NewTAP(iName)
+		if err != nil {
+			return nil, errors.New("Could not create TAP - " + err.Error())
+		}
+		return intf, nil
 	}
-	if len(addrs) == 0 {
-		return nil, errors.New("Could not resolve " + addr)
+	intf, err := water.NewTUN(iName)
+	if err != nil {
+		return nil, errors.New("Could not create TUN - " + err.Error())
 	}
+	return intf, nil
+}
 
-	rand.Seed(time.Now().Unix())
-	return addrs[rand.Int()%len(addrs)], nil
+// hostNet returns a network containing only ip.
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
 }
 
 func commandExec(command string, args []string, debug bool) error {
@@ -27,9 +40,51 @@ func commandExec(command string, args []string, debug bool) error {
 	if debug {
 		log.Println("exec "+command+": ", args)
 	}
-	e := cmd.Run()
+	out, e := cmd.CombinedOutput()
+	if e != nil {
+		e = fmt.Errorf("%s %s: %v: %s", command, strings.Join(args, " "), e, strings.TrimSpace(string(out)))
+		log.Println("Command failed: ", e)
+	}
+	return e
+}
+
+// commandExecInput is like commandExec, but writes input to the command's stdin.
+func commandExecInput(command string, args []string, input string, debug bool) error {
+	cmd := exec.Command(command, args...)
+	cmd.Stdin = strings.NewReader(input)
+	if debug {
+		log.Println("exec "+command+": ", args, input)
+	}
+	out, e := cmd.CombinedOutput()
 	if e != nil {
+		e = fmt.Errorf("%s %s: %v: %s", command, strings.Join(args, " "), e, strings.TrimSpace(string(out)))
 		log.Println("Command failed: ", e)
 	}
 	return e
 }
+
+// localNetworks returns the networks directly attached to the system, excluding
+// loopback and the interface named exclude.
+func localNetworks(exclude string) ([]*net.IPNet, error) {
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*net.IPNet
+	for _, intf := range intfs {
+		if intf.Name == exclude || intf.Flags&net.FlagLoopback != 0 || intf.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := intf.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				out = append(out, &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask})
+			}
+		}
+	}
+	return out, nil
+}
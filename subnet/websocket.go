@@ -0,0 +1,223 @@
+package subnet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twitchyliquid64/subnet/subnet/cert"
+	"github.com/twitchyliquid64/subnet/subnet/conn"
+)
+
+const (
+	// DefaultWebSocketPath is the path at which WebSocket connections are
+	// accepted, unless another is configured.
+	DefaultWebSocketPath = "/subnet"
+
+	// webSocketTokenAge is how long a client's token is accepted for after
+	// it was signed.
+	webSocketTokenAge = 5 * time.Minute
+)
+
+// webSocketServer accepts clients which tunnel their connection in a
+// WebSocket over HTTPS, to pass firewalls which only permit web traffic. It
+// can also serve plain HTTP behind a reverse proxy which terminates TLS.
+//
+// Clients authenticate with their certificate in the TLS handshake, or if
+// that is terminated by a proxy, with a token signed by the key of their
+// certificate.
+type webSocketServer struct {
+	server   *Server
+	listener net.Listener
+	path     string
+	http     *http.Server
+
+	lock sync.Mutex
+	seen map[string]time.Time // accepted tokens, until they expire
+}
+
+func newWebSocketServer(s *Server, listenAddr, path string, plain bool) (*webSocketServer, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	if !plain {
+		listener = tls.NewListener(listener, webSocketServerTLS(s.tlsConf))
+	}
+
+	w := &webSocketServer{
+		server:   s,
+		listener: listener,
+		path:     path,
+		seen:     map[string]time.Time{},
+	}
+	w.http = &http.Server{Handler: w, ReadHeaderTimeout: 10 * time.Second}
+	if plain {
+		log.Printf("Listen for WebSocket (plain HTTP) on %s%s\n", listenAddr, path)
+	} else {
+		log.Printf("Listen for WebSocket on %s%s\n", listenAddr, path)
+	}
+	return w, nil
+}
+
+// webSocketServerTLS returns a copy of the server's TLS config which also
+// admits clients without a certificate, so they can present a token instead.
+func webSocketServerTLS(tlsConf *tls.Config) *tls.Config {
+	out := tlsConf.Clone()
+	out.NextProtos = []string{"http/1.1"}
+	verifyCert, verifyConn := out.VerifyPeerCertificate, out.VerifyConnection
+	out.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return nil
+		}
+		return verifyCert(rawCerts, verifiedChains)
+	}
+	out.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return nil
+		}
+		return verifyConn(state)
+	}
+	return out
+}
+
+func (w *webSocketServer) run() {
+	go func() {
+		if err := w.http.Serve(w.listener); err != http.ErrServerClosed && !w.server.isShuttingDown {
+			log.Printf("WebSocket listener err: %s\n", err.Error())
+		}
+	}()
+}
+
+func (w *webSocketServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != w.path {
+		http.NotFound(rw, r)
+		return
+	}
+	peerCert, err := w.authenticate(r)
+	if err != nil {
+		log.Printf("WebSocket client %s rejected: %s\n", r.RemoteAddr, err.Error())
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	c, err := conn.AcceptWebSocket(rw, r)
+	if err != nil {
+		log.Printf("WebSocket upgrade for %s failed: %s\n", r.RemoteAddr, err.Error())
+		return
+	}
+	w.server.serveConn(c, cert.Identity(peerCert))
+}
+
+// authenticate returns the certificate the client presented in the TLS
+// handshake, or in a token.
+func (w *webSocketServer) authenticate(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0], nil // verified during the handshake
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return nil, errors.New("no certificate or token presented")
+	}
+	c, err := conn.VerifyToken(token, w.path, webSocketTokenAge)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.server.tlsConf.VerifyPeerCertificate([][]byte{c.Raw}, nil); err != nil {
+		return nil, err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	now := time.Now()
+	for t, expiry := range w.seen {
+		if now.After(expiry) {
+			delete(w.seen, t)
+		}
+	}
+	if _, replayed := w.seen[token]; replayed {
+		return nil, errors.New("token already used")
+	}
+	w.seen[token] = now.Add(2 * webSocketTokenAge)
+	return c, nil
+}
+
+func (w *webSocketServer) close() {
+	w.http.Close()
+}
+
+// dialWebSocket connects to the server over tcpConn with a WebSocket over
+// HTTPS. A token is sent in case TLS is terminated by a reverse proxy, in
+// which case (with -ws-behind-proxy) the proxy's certificate must be valid for
+// the server's host name.
+func (c *Client) dialWebSocket(tcpConn net.Conn, server *serverAddr) (net.Conn, error) {
+	host := c.tlsConf.ServerName
+	if host == "" {
+		host = server.host
+	}
+	tlsConn, err := conn.Handshake(tcpConn, webSocketClientTLS(c.tlsConf, host, c.wsBehindProxy), true, false)
+	if err != nil {
+		return nil, err
+	}
+	token, err := conn.SignToken(c.tlsConf.Certificates[0], c.wsPath)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+
+	if server.port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(server.port))
+	}
+	ws, err := conn.DialWebSocket(tlsConn, host, c.wsPath, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// webSocketClientTLS returns a copy of the client's TLS config for host. If
+// behindProxy is set, it also accepts a certificate valid for host under the
+// system's roots.
+func webSocketClientTLS(tlsConf *tls.Config, host string, behindProxy bool) *tls.Config {
+	out := tlsConf.Clone()
+	out.ServerName = host
+	out.NextProtos = []string{"http/1.1"}
+	if !behindProxy {
+		return out
+	}
+	verifyCert, verifyConn := out.VerifyPeerCertificate, out.VerifyConnection
+	out.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		err := verifyCert(rawCerts, verifiedChains)
+		if err == nil {
+			return nil
+		}
+		var certs []*x509.Certificate
+		for _, raw := range rawCerts {
+			c, parseErr := x509.ParseCertificate(raw)
+			if parseErr != nil {
+				return parseErr
+			}
+			certs = append(certs, c)
+		}
+		if conn.VerifyHostCertificate(certs, host) == nil {
+			log.Printf("Certificate for %s is trusted by the system, assuming a reverse proxy.\n", host)
+			return nil
+		}
+		return err
+	}
+	out.VerifyConnection = func(state tls.ConnectionState) error {
+		err := verifyConn(state)
+		if err != nil && conn.VerifyHostCertificate(state.PeerCertificates, host) == nil {
+			return nil
+		}
+		return err
+	}
+	return out
+}
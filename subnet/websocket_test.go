@@ -0,0 +1,46 @@
+package subnet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/twitchyliquid64/subnet/subnet/conn"
+	"github.com/twitchyliquid64/subnet/subnet/conn/conntest"
+)
+
+func TestWebSocketTokenReplay(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := conn.SignToken(conntest.SelfSignedCert(t, key), DefaultWebSocketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &webSocketServer{
+		server: &Server{tlsConf: &tls.Config{
+			VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error { return nil },
+		}},
+		path: DefaultWebSocketPath,
+		seen: map[string]time.Time{},
+	}
+	authenticate := func() error {
+		r := httptest.NewRequest("GET", DefaultWebSocketPath, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		_, err := w.authenticate(r)
+		return err
+	}
+	if err := authenticate(); err != nil {
+		t.Fatalf("first use of token: %v", err)
+	}
+	if err := authenticate(); err == nil {
+		t.Error("replayed token was accepted")
+	}
+}